@@ -14,6 +14,10 @@ type myCanvas struct {
 
 /* Implements Canvas interface */
 func (c *myCanvas) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	return c.AddShapeWithFee(validateNum, shapeType, shapeSvgString, fill, stroke, 0)
+}
+
+func (c *myCanvas) AddShapeWithFee(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string, fee uint32) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
 	if fill == "" || stroke == "" {
 		err = shared.InvalidShapeSvgStringError(shapeSvgString)
 		return
@@ -28,7 +32,8 @@ func (c *myCanvas) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgStri
 			ShapeType:      shared.ShapeType(shapeType),
 			ShapeSvgString: shapeSvgString,
 			Fill:           fill,
-			Stroke:         stroke},
+			Stroke:         stroke,
+			Fee:            fee},
 		&reply)
 
 	if err != nil {
@@ -156,6 +161,87 @@ func (c *myCanvas) GetChildren(blockHash string) (blockHashes []string, err erro
 	return
 }
 
+func (c *myCanvas) GetBlock(blockHash string) (block BlockInfo, err error) {
+	var reply shared.BlockInfo
+
+	err = c.client.Call("MinerArtRPC.GetBlock", blockHash, &reply)
+	if err != nil {
+		err = maskRPCServerErr(err, c.serverAddr)
+		return
+	}
+
+	block = BlockInfo(reply)
+	return
+}
+
+func (c *myCanvas) GetOp(opHash string) (op OpInfo, err error) {
+	var reply shared.OpInfo
+
+	err = c.client.Call("MinerArtRPC.GetOp", opHash, &reply)
+	if err != nil {
+		err = maskRPCServerErr(err, c.serverAddr)
+		return
+	}
+
+	op = OpInfo(reply)
+	return
+}
+
+func (c *myCanvas) GetInkBalance() (balance InkBalance, err error) {
+	var reply shared.InkBalance
+
+	err = c.client.Call("MinerArtRPC.GetInkBalance", 0, &reply)
+	if err != nil {
+		err = maskRPCServerErr(err, c.serverAddr)
+		return
+	}
+
+	balance = InkBalance(reply)
+	return
+}
+
+func (c *myCanvas) GetInkTable(blockHash string) (inkTable map[string]uint32, err error) {
+	err = c.client.Call("MinerArtRPC.GetInkTable", blockHash, &inkTable)
+	if err != nil {
+		err = maskRPCServerErr(err, c.serverAddr)
+	}
+	return
+}
+
+func (c *myCanvas) GetLongestChain() (blockHashes []string, err error) {
+	err = c.client.Call("MinerArtRPC.GetLongestChain", 0, &blockHashes)
+	if err != nil {
+		err = maskRPCServerErr(err, c.serverAddr)
+	}
+	return
+}
+
+func (c *myCanvas) GetBlockHeader(blockHash string) (header BlockHeader, err error) {
+	var reply shared.BlockHeader
+
+	err = c.client.Call("MinerArtRPC.GetBlockHeader", blockHash, &reply)
+	if err != nil {
+		err = maskRPCServerErr(err, c.serverAddr)
+		return
+	}
+
+	header = BlockHeader(reply)
+	return
+}
+
+func (c *myCanvas) GetOpProof(shapeHash string) (proof OpProof, err error) {
+	var reply shared.OpProof
+
+	err = c.client.Call("MinerArtRPC.GetOpProof", shapeHash, &reply)
+	if err != nil {
+		err = maskRPCServerErr(err, c.serverAddr)
+		return
+	}
+
+	proof = OpProof(reply)
+	return
+}
+
 func (c *myCanvas) CloseCanvas() (inkRemaining uint32, err error) {
 	err = c.client.Call(
 		"MinerArtRPC.CloseCanvas",
@@ -17,6 +17,11 @@ import (
 /* Aliases for shared constants and types */
 type CanvasSettings shared.CanvasSettings
 type ShapeType shared.ShapeType
+type BlockInfo shared.BlockInfo
+type OpInfo shared.OpInfo
+type BlockHeader shared.BlockHeader
+type OpProof shared.OpProof
+type InkBalance shared.InkBalance
 
 const (
 	PATH = ShapeType(shared.PATH)
@@ -47,6 +52,7 @@ type ShapeOwnerError shared.ShapeOwnerError
 type OutOfBoundsError shared.OutOfBoundsError
 type ShapeOverlapError shared.ShapeOverlapError
 type InvalidBlockHashError shared.InvalidBlockHashError
+type ConfirmationTimeoutError shared.ConfirmationTimeoutError
 
 // </ERROR DEFINITIONS>
 ////////////////////////////////////////////////////////////////////////////////////////////
@@ -61,8 +67,15 @@ type Canvas interface {
 	// - ShapeSvgStringTooLongError
 	// - ShapeOverlapError
 	// - OutOfBoundsError
+	// - ConfirmationTimeoutError
 	AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
 
+	// Same as AddShape, also paying fee ink to the miner of the block
+	// holding the shape. Miners may mine ops paying higher fees first.
+	// Deleting the shape later pays no fee.
+	// Can return the same errors as AddShape.
+	AddShapeWithFee(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string, fee uint32) (shapeHash string, blockHash string, inkRemaining uint32, err error)
+
 	// Returns the encoding of the shape as an svg string.
 	// Can return the following errors:
 	// - DisconnectedError
@@ -74,10 +87,17 @@ type Canvas interface {
 	// - DisconnectedError
 	GetInk() (inkRemaining uint32, err error)
 
+	// Returns the ink that can be spent, and the ink mined in blocks
+	// that are not buried deep enough to spend it yet.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetInkBalance() (balance InkBalance, err error)
+
 	// Removes a shape from the canvas.
 	// Can return the following errors:
 	// - DisconnectedError
 	// - ShapeOwnerError
+	// - ConfirmationTimeoutError
 	DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error)
 
 	// Retrieves hashes contained by a specific block.
@@ -97,6 +117,42 @@ type Canvas interface {
 	// - InvalidBlockHashError
 	GetChildren(blockHash string) (blockHashes []string, err error)
 
+	// Returns a block's miner, nonce, height, confirmations and ops.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	GetBlock(blockHash string) (block BlockInfo, err error)
+
+	// Returns an op with its signer, containing block and confirmation count.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	GetOp(opHash string) (op OpInfo, err error)
+
+	// Returns the ink of every miner as of a block, keyed by public key.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	GetInkTable(blockHash string) (inkTable map[string]uint32, err error)
+
+	// Returns the block hashes of the longest chain, from the genesis block to its leaf.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetLongestChain() (blockHashes []string, err error)
+
+	// Returns the fields a block's hash commits to, including the Merkle root of its ops.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	GetBlockHeader(blockHash string) (header BlockHeader, err error)
+
+	// Returns the Merkle branch linking a mined op (shape hash returned
+	// by AddShape) to the header of its block. Check it with VerifyOpInBlock.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	GetOpProof(shapeHash string) (proof OpProof, err error)
+
 	// Closes the canvas/connection to the BlockArt network.
 	// - DisconnectedError
 	CloseCanvas() (inkRemaining uint32, err error)
@@ -136,6 +192,16 @@ func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, sett
 	return
 }
 
+// Returns true if proof shows that the op sits in the block identified
+// by blockHash, using only that block's header.
+// The miner serving header and proof does not need to be trusted.
+func VerifyOpInBlock(blockHash string, header BlockHeader, proof OpProof) bool {
+	if proof.BlockHash != blockHash {
+		return false
+	}
+	return shared.VerifyOpProof(shared.BlockHeader(header), shared.OpProof(proof))
+}
+
 func init() {
 	log = shared.NewLogger(false, false, true)
 }
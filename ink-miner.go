@@ -3,15 +3,34 @@ package main
 import (
 	"./miner"
 	"./shared"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
 	"net"
 	"net/rpc"
 	"os"
+	"path/filepath"
 	"time"
 )
 
-// go run ink-miner.go [server ip:port] [pubKey] [privKey]
+// Directory holding the per-miner data directories when none is given
+const defaultDataRoot = "minerdata"
+
+// File in the data directory holding the IP:Port of the admin rpc server
+const adminAddrFile = "admin-addr"
+
+var (
+	engine      *miner.Engine
+	privKey     *ecdsa.PrivateKey
+	pubKeyStr   string
+	minerIPPort string // IP:Port for miner-miner
+	dataDir     string // Directory holding the miner's block store
+	settings    miner.MinerNetSettings
+)
+
+// go run ink-miner.go [server ip:port] [pubKey] [privKey] [dataDir (optional)]
 func main() {
 	args := os.Args[1:]
 	miner.Log.Trace(args)
@@ -21,37 +40,58 @@ func main() {
 		os.Exit(1)
 	}
 
-	listener, err := miner.InitRPCServer(new(miner.MinerMinerRPC))
+	// Listen before registering, the server hands our address to other miners
+	listener, err := miner.ListenOutbound()
 	if err != nil {
 		miner.Log.Error("Failed to set up rpc between miners [%s]", err.Error())
 		os.Exit(1)
 	}
 	defer listener.Close()
-	miner.MinerIPPort = listener.Addr().String()
+	minerIPPort = listener.Addr().String()
 
-	serverConn, err := contactServer(miner.MinerIPPort)
+	serverConn, err := contactServer(minerIPPort)
 	if err != nil {
 		miner.Log.Error("Failed to register with server [%s]", err.Error())
 		os.Exit(1)
 	}
-	miner.Log.Debug("Received settings from server [%v]", miner.NetSettings)
+	miner.Log.Debug("Received settings from server [%v]", settings)
 	miner.Server = serverConn
 
+	engine, err = miner.NewEngine(settings, privKey, miner.NewRPCTransport(), dataDir)
+	if err != nil {
+		miner.Log.Error("Failed to create miner [%s]", err.Error())
+		os.Exit(1)
+	}
+	engine.MinerIPPort = minerIPPort
+
+	err = serveAdmin()
+	if err != nil {
+		miner.Log.Error("Failed to set up admin rpc [%s]", err.Error())
+		os.Exit(1)
+	}
+
+	err = miner.ServeRPC(listener, miner.NewMinerMinerRPC(engine))
+	if err != nil {
+		miner.Log.Error("Failed to set up rpc between miners [%s]", err.Error())
+		os.Exit(1)
+	}
+
 	HeartBeatLoop()
 	ConnectToMiners()
 
-	miner.Log.Debug("Num neighbours initially connected to: [%v]", miner.NumNeighbours)
+	miner.Log.Debug("Num neighbours initially connected to: [%v]", engine.Transport.NumNeighbours())
 	CheckNeighbours()
 
 	// create a thread for artnode-miner rpc server
-	_, err = miner.InitRPCServer(new(miner.MinerArtRPC))
+	artListener, err := miner.InitRPCServer(miner.NewMinerArtRPC(engine))
 	if err != nil {
 		miner.Log.Error("Failed to set up rpc between artnode and miner [%s]", err.Error())
 		os.Exit(1)
 	}
+	engine.ArtIPPort = artListener.Addr().String()
 
 	// Initialize miner-miner
-	err, done := miner.InitBlockchain()
+	err, done := engine.InitBlockchain()
 	if err != nil {
 		miner.Log.Error("Failed to initialize miner blockchain", err.Error())
 		os.Exit(1)
@@ -66,19 +106,39 @@ func main() {
 	miner.Log.Trace("Miner exiting")
 }
 
+// Serve the admin rpc on localhost, and record its address in the data
+// directory for tools/miner-admin.go
+func serveAdmin() (err error) {
+	adminListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	err = miner.ServeRPC(adminListener, miner.NewMinerAdminRPC(engine))
+	if err != nil {
+		return
+	}
+
+	adminIPPort := adminListener.Addr().String()
+	miner.Log.Debug("Admin rpc listening on [%s]", adminIPPort)
+	if err = os.MkdirAll(dataDir, 0700); err != nil {
+		return
+	}
+	return ioutil.WriteFile(filepath.Join(dataDir, adminAddrFile), []byte(adminIPPort), 0600)
+}
+
 func contactServer(serverAddr string) (server *rpc.Client, err error) {
 	gob.Register(&net.TCPAddr{})
 	gob.Register(&elliptic.CurveParams{})
 
-	minerAddr, err := net.ResolveTCPAddr("tcp", miner.MinerIPPort)
+	minerAddr, err := net.ResolveTCPAddr("tcp", minerIPPort)
 	server, err = rpc.Dial("tcp", miner.ServerIPPort)
 	if err != nil {
 		return
 	}
 
-	registerArgs := shared.RegisterArgs{Address: minerAddr, Key: miner.PrivKey.PublicKey}
-	miner.Log.Debug("Registering with: [%v] [%v]", minerAddr, miner.PrivKey.PublicKey)
-	err = server.Call("RServer.Register", registerArgs, &miner.NetSettings)
+	registerArgs := shared.RegisterArgs{Address: minerAddr, Key: privKey.PublicKey}
+	miner.Log.Debug("Registering with: [%v] [%v]", minerAddr, privKey.PublicKey)
+	err = server.Call("RServer.Register", registerArgs, &settings)
 	if err != nil {
 		return
 	}
@@ -86,16 +146,16 @@ func contactServer(serverAddr string) (server *rpc.Client, err error) {
 }
 
 func SendHeartBeat() (err error) {
-	err = miner.Server.Call("RServer.HeartBeat", miner.PrivKey.PublicKey, nil)
+	err = miner.Server.Call("RServer.HeartBeat", privKey.PublicKey, nil)
 	if err != nil {
 		// try re-registering with the server
 		miner.Log.Trace("Failed to send heartbeat to server. Reregistering...")
-		minerAddr, _ := net.ResolveTCPAddr("tcp", miner.MinerIPPort)
-		registerArgs := shared.RegisterArgs{Address: minerAddr, Key: miner.PrivKey.PublicKey}
+		minerAddr, _ := net.ResolveTCPAddr("tcp", minerIPPort)
+		registerArgs := shared.RegisterArgs{Address: minerAddr, Key: privKey.PublicKey}
 		err = miner.Server.Call("RServer.Register", registerArgs, nil)
 		return
 	}
-	time.Sleep(time.Duration(miner.NetSettings.HeartBeat) * 500 * time.Microsecond)
+	time.Sleep(time.Duration(settings.HeartBeat) * 500 * time.Microsecond)
 	return
 }
 
@@ -111,30 +171,20 @@ func HeartBeatLoop() {
 }
 
 func ConnectToMiners() (err error) {
-	minerInfo := shared.ConnectMinerArgs{IPPort: miner.MinerIPPort, EncodedPubKey: miner.PubKeyStr}
 	var minerAddrs []net.Addr
 
-	err = miner.Server.Call("RServer.GetNodes", miner.PrivKey.PublicKey, &minerAddrs)
+	err = miner.Server.Call("RServer.GetNodes", privKey.PublicKey, &minerAddrs)
 	if err != nil {
 		miner.Log.Error("Error from server [%s]", err.Error())
 		return
 	}
 
 	for _, addr := range minerAddrs {
-		if conn, connErr := rpc.Dial("tcp", addr.String()); connErr == nil {
-			var minerPubKey string
-			c := make(chan error, 1)
-			c <- conn.Call("MinerMinerRPC.Connect", minerInfo, &minerPubKey)
-			select {
-			case connErr := <-c:
-				if connErr == nil && minerPubKey != "" {
-					miner.UpdateNeighbours(minerPubKey, conn)
-				}
-				return
-			case <-time.After(100 * time.Millisecond):
-				return
-			}
+		_, connErr := engine.ConnectPeer(addr.String())
+		if connErr == nil {
+			return
 		}
+		miner.Log.Error("Cannot connect to miner [%s] [%s]", addr.String(), connErr.Error())
 	}
 	return
 }
@@ -142,47 +192,64 @@ func ConnectToMiners() (err error) {
 // Check on all the neighbours every 5 seconds
 func CheckNeighbours() {
 	reply := new(bool)
-	minConns := miner.NetSettings.MinNumMinerConnections
+	minConns := settings.MinNumMinerConnections
 	go func() {
+		// Set once a reconnect is needed, the blocks missed meanwhile are
+		// synced once the miner is connected again
+		missedBlocks := false
 		for {
-			for pKey, conn := range miner.ActiveNeighbours {
+			for pKey, conn := range engine.Transport.Neighbours() {
 				err := conn.Call("MinerMinerRPC.IsAlive", 0, reply)
 				if err != nil {
-					miner.RemoveInactiveMiner(pKey)
+					engine.DisconnectPeer(pKey)
 				}
 				// Check that we still have enough ink miners
-				if miner.NumNeighbours < int(minConns) {
+				if engine.Transport.NumNeighbours() < int(minConns) {
+					missedBlocks = true
 					err = ConnectToMiners()
 					if err != nil {
 						miner.Log.Error("Cannot contact server to get new miners [%s]", err.Error())
 					}
 				}
 			}
+			if missedBlocks && engine.Transport.NumNeighbours() >= int(minConns) {
+				// Catch up on the blocks missed while poorly connected
+				missedBlocks = false
+				engine.ResyncWithNetwork()
+			}
 			time.Sleep(miner.CheckInterval)
 		}
 	}()
 }
 
 func parseArgs(args []string) (err error) {
-	if len(args) != 3 {
-		miner.Log.Error("invalid number of arguments\nusage: $ go run ink-miner.go [server ip:port] [pubKey] [privKey]")
+	if len(args) != 3 && len(args) != 4 {
+		miner.Log.Error("invalid number of arguments\nusage: $ go run ink-miner.go [server ip:port] [pubKey] [privKey] [dataDir (optional)]")
 		err = os.ErrInvalid
 		return
 	}
 
 	// Get args
 	miner.ServerIPPort = args[0]
-	miner.PrivKey, err = shared.DecodePrivKey(args[2])
+	privKey, err = shared.DecodePrivKey(args[2])
 	if err != nil {
 		miner.Log.Error("Failed to parse key pairs [%s]", err.Error())
 		return
 	}
 
-	// Store public key string in common
-	miner.PubKeyStr, err = shared.EncodePubKey(miner.PrivKey.PublicKey)
+	// Public key string identifies this miner to the other miners
+	pubKeyStr, err = shared.EncodePubKey(privKey.PublicKey)
 	if err != nil {
 		miner.Log.Debug("Couldn't encode key: [%s]", err.Error())
 	}
 
+	// Keep each miner's blocks apart so several miners can share a machine
+	if len(args) == 4 {
+		dataDir = args[3]
+	} else {
+		keyHash := hex.EncodeToString(shared.HashByteArr([]byte(pubKeyStr)))
+		dataDir = filepath.Join(defaultDataRoot, keyHash)
+	}
+
 	return
 }
@@ -0,0 +1,161 @@
+package miner
+
+import (
+	"../shared"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Control and inspection of a running miner, see MinerAdminRPC
+// ---------------------------------------------------------------------
+
+// Stop mining after the block being mined, until ResumeMining.
+// Blocks and ops are still received and flooded.
+func (e *Engine) PauseMining() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.miningPaused = true
+	e.interruptMining()
+}
+
+// Mine again after PauseMining
+func (e *Engine) ResumeMining() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.miningPaused = false
+	e.miningResumed.Broadcast()
+}
+
+// Add the time spent on a nonce search, and the expected work of the block
+// if it was sealed
+func (e *Engine) recordSealing(elapsed time.Duration, sealed bool, difficulty uint8) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.sealingTime += elapsed
+	if sealed {
+		e.sealedWork.Add(e.sealedWork, BlockWork(difficulty))
+	}
+}
+
+// Return an estimate of the hashes per second the miner computes: the
+// expected work of the blocks it sealed over the time spent searching for
+// nonces, out-dated searches included. It is 0 until a block is sealed.
+func (e *Engine) HashRate() float64 {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.hashRate()
+}
+
+// Same as HashRate, with e.lock held
+func (e *Engine) hashRate() float64 {
+	if e.sealingTime <= 0 {
+		return 0
+	}
+	work, _ := new(big.Float).SetInt(e.sealedWork).Float64()
+	return work / e.sealingTime.Seconds()
+}
+
+// Return the miner's state
+func (e *Engine) GetStatus() shared.MinerStatus {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return shared.MinerStatus{
+		PubKey:         e.PubKeyStr,
+		MiningPaused:   e.miningPaused,
+		TipHash:        e.longestLeafHash,
+		Height:         e.treeTable[e.longestLeafHash].Height,
+		HashRate:       e.hashRate(),
+		QueuedOps:      len(e.opQueue),
+		NoParentBlocks: e.orphans.len(),
+		Neighbours:     e.Transport.NumNeighbours(),
+	}
+}
+
+// Return the ops waiting to be mined, in the order they are picked for a block
+func (e *Engine) GetQueuedOps() (ops []shared.OpInfo) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	for _, opHash := range e.queuedOpHashes() {
+		ops = append(ops, toOpInfo(*e.opQueue[opHash], "", -1))
+	}
+	return ops
+}
+
+// Return the blocks waiting for their parent, oldest timestamp first
+func (e *Engine) GetNoParentBlocks() (blocks []shared.BlockInfo) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	for _, block := range e.orphans.list() {
+		blockHash := block.Hash()
+		info := shared.BlockInfo{
+			Version:       block.GetVersion(),
+			Hash:          blockHash,
+			PrevHash:      block.GetPrevHash(),
+			MinerPubKey:   block.GetMinerPubKey(),
+			Nonce:         block.GetNonce(),
+			ExtraNonce:    block.GetExtraNonce(),
+			Timestamp:     block.GetTimestamp(),
+			IsOpBlock:     isOpBlock(block),
+			Confirmations: -1,
+		}
+		for _, op := range block.GetOps() {
+			info.Ops = append(info.Ops, toOpInfo(op, blockHash, -1))
+		}
+		blocks = append(blocks, info)
+	}
+	return blocks
+}
+
+// Return the public keys of the connected neighbours
+func (e *Engine) GetNeighbours() (pubKeys []string) {
+	for pubKey := range e.Transport.Neighbours() {
+		pubKeys = append(pubKeys, pubKey)
+	}
+	sort.Strings(pubKeys)
+	return pubKeys
+}
+
+// Connect to the miner listening at ipPort, the same way a new miner
+// connects to the miners the server hands it: both miners sign the
+// session of the handshake, see Engine.Hello
+// Returns the neighbour's public key
+// Can return the following errors:
+// - DisconnectedError
+// - HandshakeError
+func (e *Engine) ConnectPeer(ipPort string) (pubKey string, err error) {
+	peer, err := e.Transport.Dial(ipPort)
+	if err != nil {
+		return "", shared.DisconnectedError(ipPort)
+	}
+
+	if pubKey, err = e.handshake(peer, ipPort, "MinerMinerRPC.Connect", ""); err != nil {
+		peer.Close()
+		return "", err
+	}
+
+	// Already a neighbour: the old connection is kept
+	e.Transport.AddNeighbour(pubKey, peer)
+	return pubKey, nil
+}
+
+// Close the connection to a neighbour
+// Can return the following errors:
+// - UnknownPeerError
+func (e *Engine) DisconnectPeer(pubKey string) error {
+	if _, connected := e.Transport.Neighbours()[pubKey]; !connected {
+		return shared.UnknownPeerError(pubKey)
+	}
+	e.Transport.RemoveNeighbour(pubKey)
+	e.inv.removePeer(pubKey)
+	e.outbound.remove(pubKey)
+	return nil
+}
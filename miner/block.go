@@ -8,6 +8,9 @@ import (
 
 // The Block Unit in blockchain
 type Block interface {
+	// Get the header format version, which also selects the hash function
+	GetVersion() (version shared.BlockVersion)
+
 	// Get the previous block's hash
 	GetPrevHash() (hash string)
 
@@ -17,14 +20,21 @@ type Block interface {
 	// Get the nonce of the block, produced by the miner indicated by MinerPubKey
 	GetNonce() (nonce uint32)
 
+	// Get the extra nonce, moved on by the miner once every nonce was tried
+	GetExtraNonce() (extraNonce uint32)
+
+	// Get the Unix time in milliseconds the block was mined at
+	GetTimestamp() (timestamp int64)
+
 	// Get the operations in OpBlock.
 	// ops is nil in NoOpBlock
 	GetOps() (ops []Op)
 
+	// Get the fields the block hash commits to
+	Header() (header shared.BlockHeader)
+
 	// Hashes all of the block's fields into string
 	Hash() (hashedBlock string)
-
-	GetPowDifficulty() (difficulty uint8)
 }
 
 // Op: contains the operation of art note
@@ -34,28 +44,41 @@ type Op struct {
 	OpSig    shared.OpenArgs // Shape operation signed with a private key of miner generator
 	PubKey   string          // Public key of the miner owner of this Op
 	ValidNum uint8           // Number of blocks required after this block to be rewarded inks
+	Fee      uint32          // Ink paid by PubKey to the miner of the block holding the op, covered by OpSig
+
+	// Hash of the add op whose shape a delete op removes, empty for an add op
+	AddOpHash string
 }
 
 // Op Block that implements Block
 type OpBlock struct {
+	Version     shared.BlockVersion
 	PrevHash    string
 	Ops         []Op   // List of operations
 	PubKeyMiner string // Public key of the miner who made the Op block
+	Timestamp   int64
 	Nonce       uint32
+	ExtraNonce  uint32
 }
 
 // No-Op block that implements Block
 type NoOpBlock struct {
+	Version     shared.BlockVersion
 	PrevHash    string
 	PubKeyMiner string
+	Timestamp   int64
 	Nonce       uint32
+	ExtraNonce  uint32
 }
 
 // General block struct for holding either NoOp or Op blocks
 type GeneralBlock struct {
+	Version     shared.BlockVersion
 	PrevHash    string
 	PubKeyMiner string
+	Timestamp   int64
 	Nonce       uint32
+	ExtraNonce  uint32
 	Ops         []Op
 }
 
@@ -63,100 +86,143 @@ type GeneralBlock struct {
 // Hash functions
 // ---------------------------------------------------------------------
 
-// Hash Op's fields into byte arrays
-// Fields: op, op-signature, pub-key,
+// Hash the op's identity into byte arrays: the bytes OpSig signs and the
+// signer's public key. The signature itself is left out, since a second
+// valid signature can be made from the first: keyed on the signature, an op
+// could be replayed under a new hash and charged again.
+// The hash is also the op's Merkle leaf; its signature is checked when its
+// block is validated.
 func (op Op) HashToBytes() []byte {
-	opBytes := op.Op.HashToBytes()
-	opSigRBytes, _ := op.OpSig.R.GobEncode()
-	opSigSBytes, _ := op.OpSig.S.GobEncode()
-	pubKeyBytes := []byte(op.PubKey)
-	validNumBytes := make([]byte, 1)
-	validNumBytes[0] = byte(op.ValidNum)
-	AddBytes := make([]byte, 1)
+	args := [][]byte{op.SignedBytes(), []byte(op.PubKey)}
+	return op.Op.Version.Hash(shared.ConcateByteArr(args))
+}
+
+// Hash the op's identity into string, see HashToBytes
+func (op Op) HashToString() string {
+	bytes := op.HashToBytes()
+	return hex.EncodeToString(bytes[:])
+}
+
+// Return the bytes OpSig signs: the shape hash, whether the op adds or
+// deletes it, ValidNum and the fee. A delete op also signs the add op it
+// deletes, so an add op's signature can't be reused to delete its shape.
+func (op Op) SignedBytes() []byte {
+	addBytes := []byte{0}
 	if op.Add {
-		AddBytes[0] = 1
-	} else {
-		AddBytes[0] = 0
+		addBytes[0] = 1
 	}
-	args := [5][]byte{opBytes, opSigRBytes, opSigSBytes, pubKeyBytes, validNumBytes}
-
-	opBytes = shared.ConcateByteArr(args[:])
+	args := [][]byte{op.Op.HashToBytes(), addBytes, []byte{op.ValidNum}, feeBytes(op.Fee)}
 	if !op.Add {
-		// Due to weird hashing behaviour that op is hashed to same bytes regardless of Add
-		// manually set the bytes differently
-		opBytes[0] = 15
+		args = append(args, []byte(op.AddOpHash))
 	}
+	return op.Op.Version.Hash(shared.ConcateByteArr(args))
+}
 
-	return shared.HashByteArr(opBytes)
+func feeBytes(fee uint32) []byte {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, fee)
+	return bytes
 }
 
-// Hash Op's fields into string
-// Fields: op, op-signature, pub-key,
-func (op Op) HashToString() string {
-	bytes := op.HashToBytes()
-	return hex.EncodeToString(bytes[:])
+// Return the size of op as it is sent to other miners, gob encoded
+func OpSize(op Op) int {
+	return len(shared.Serialize(op))
 }
 
-// Hashes OpBlock to string
+// Return the Merkle tree leaves of ops: the op hashes, in block order
+func OpMerkleLeaves(ops []Op) (leaves [][]byte) {
+	for _, op := range ops {
+		leaves = append(leaves, op.HashToBytes())
+	}
+	return leaves
+}
+
+// Header of the OpBlock, committing to its ops through their Merkle root
 // Precondition: must contain an ops
-func (block OpBlock) Hash() (hashedBlock string) {
+func (block OpBlock) Header() shared.BlockHeader {
 	// Precondition check: OpBlock contains ops
 	ops := block.GetOps()
 	if len(ops) == 0 {
 		Log.Error("OpBlock must contain operations")
 	}
 
-	// Previous hash bytes
-	prevHashBytes := []byte(block.GetPrevHash())
-
-	// Append all the ops within the block
-	var opsBytes []byte
-	for _, op := range ops {
-		opHash := op.HashToBytes()
-		opsBytes = append(opsBytes, opHash[:]...)
+	return shared.BlockHeader{
+		Version:     block.GetVersion(),
+		PrevHash:    block.GetPrevHash(),
+		MerkleRoot:  hex.EncodeToString(shared.MerkleRoot(block.GetVersion(), OpMerkleLeaves(ops))),
+		PubKeyMiner: block.GetMinerPubKey(),
+		Timestamp:   block.GetTimestamp(),
+		Nonce:       block.GetNonce(),
+		ExtraNonce:  block.GetExtraNonce(),
 	}
+}
 
-	// Miner pubkey bytes
-	minerPubKeyBytes := []byte(block.GetMinerPubKey())
-
-	// Nonce bytes
-	nonceBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(nonceBytes, block.GetNonce())
-
-	args := [4][]byte{prevHashBytes, opsBytes, minerPubKeyBytes, nonceBytes}
-	hashedByteArr := shared.HashByteArr(shared.ConcateByteArr(args[:]))
+// Hashes OpBlock to string
+// Precondition: must contain an ops
+func (block OpBlock) Hash() (hashedBlock string) {
+	return block.Header().Hash()
+}
 
-	return hex.EncodeToString(hashedByteArr[:])
+// Header of the NoOpBlock, it has no Merkle root
+func (block NoOpBlock) Header() shared.BlockHeader {
+	return shared.BlockHeader{
+		Version:     block.GetVersion(),
+		PrevHash:    block.GetPrevHash(),
+		PubKeyMiner: block.GetMinerPubKey(),
+		Timestamp:   block.GetTimestamp(),
+		Nonce:       block.GetNonce(),
+		ExtraNonce:  block.GetExtraNonce(),
+	}
 }
 
 // Hashes NoOpBlock to string
 func (block NoOpBlock) Hash() (hashedBlock string) {
-	prevHashBytes := []byte(block.GetPrevHash())
-	minerPubKeyBytes := []byte(block.GetMinerPubKey())
-	nonceBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(nonceBytes, block.GetNonce())
-	args := [3][]byte{prevHashBytes, minerPubKeyBytes, nonceBytes}
-	hashedByteArr := shared.HashByteArr(shared.ConcateByteArr(args[:]))
-
-	return hex.EncodeToString(hashedByteArr[:])
-}
-
-// Return a new Op with Add field set
-func SetOpAdd(op Op, add bool) (newOp Op) {
-	newOp = Op{
-		Op:       op.Op,
-		OpSig:    op.OpSig,
-		PubKey:   op.PubKey,
-		ValidNum: op.ValidNum,
-		Add:      add,
+	return block.Header().Hash()
+}
+
+// Package a concrete block into a GeneralBlock for rpc args and storage
+func ToGeneralBlock(block Block) GeneralBlock {
+	return GeneralBlock{
+		Version:     block.GetVersion(),
+		PrevHash:    block.GetPrevHash(),
+		PubKeyMiner: block.GetMinerPubKey(),
+		Timestamp:   block.GetTimestamp(),
+		Nonce:       block.GetNonce(),
+		ExtraNonce:  block.GetExtraNonce(),
+		Ops:         block.GetOps(),
 	}
+}
 
-	return newOp
+// Convert a GeneralBlock back to its concrete block type
+// A block without ops is a NoOpBlock
+func (genBlock GeneralBlock) ToBlock() Block {
+	if len(genBlock.Ops) == 0 {
+		return NoOpBlock{
+			Version:     genBlock.Version,
+			PrevHash:    genBlock.PrevHash,
+			PubKeyMiner: genBlock.PubKeyMiner,
+			Timestamp:   genBlock.Timestamp,
+			Nonce:       genBlock.Nonce,
+			ExtraNonce:  genBlock.ExtraNonce,
+		}
+	}
+	return OpBlock{
+		Version:     genBlock.Version,
+		PrevHash:    genBlock.PrevHash,
+		Ops:         genBlock.Ops,
+		PubKeyMiner: genBlock.PubKeyMiner,
+		Timestamp:   genBlock.Timestamp,
+		Nonce:       genBlock.Nonce,
+		ExtraNonce:  genBlock.ExtraNonce,
+	}
 }
 
 // ---------------------------------------------------------------------
 // Getters for OpBlock
 // ---------------------------------------------------------------------
+func (opBlock OpBlock) GetVersion() (version shared.BlockVersion) {
+	return opBlock.Version
+}
 func (opBlock OpBlock) GetPrevHash() (hash string) {
 	return opBlock.PrevHash
 }
@@ -166,17 +232,22 @@ func (opBlock OpBlock) GetMinerPubKey() (minerPubKey string) {
 func (opBlock OpBlock) GetNonce() (nonce uint32) {
 	return opBlock.Nonce
 }
+func (opBlock OpBlock) GetExtraNonce() (extraNonce uint32) {
+	return opBlock.ExtraNonce
+}
+func (opBlock OpBlock) GetTimestamp() (timestamp int64) {
+	return opBlock.Timestamp
+}
 func (opBlock OpBlock) GetOps() (ops []Op) {
 	return opBlock.Ops
 }
 
-func (opBlock OpBlock) GetPowDifficulty() (difficulty uint8) {
-	return NetSettings.PoWDifficultyOpBlock
-}
-
 // ---------------------------------------------------------------------
 // Getters for NoOpBlock
 // ---------------------------------------------------------------------
+func (noOpBlock NoOpBlock) GetVersion() (version shared.BlockVersion) {
+	return noOpBlock.Version
+}
 func (noOpBlock NoOpBlock) GetPrevHash() (hash string) {
 	return noOpBlock.PrevHash
 }
@@ -186,12 +257,14 @@ func (noOpBlock NoOpBlock) GetMinerPubKey() (minerPubKey string) {
 func (noOpBlock NoOpBlock) GetNonce() (nonce uint32) {
 	return noOpBlock.Nonce
 }
+func (noOpBlock NoOpBlock) GetExtraNonce() (extraNonce uint32) {
+	return noOpBlock.ExtraNonce
+}
+func (noOpBlock NoOpBlock) GetTimestamp() (timestamp int64) {
+	return noOpBlock.Timestamp
+}
 
 // Noop does not have operations
 func (noOpBlock NoOpBlock) GetOps() (ops []Op) {
 	return ops
 }
-
-func (noOpBlock NoOpBlock) GetPowDifficulty() (difficulty uint8) {
-	return NetSettings.PoWDifficultyNoOpBlock
-}
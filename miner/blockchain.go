@@ -2,9 +2,13 @@ package miner
 
 import (
 	"../shared"
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"errors"
+	"math/big"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -38,43 +42,15 @@ type RawGenBlockchain []GeneralBlock
 
 // Blockchain represented in tree structure
 type BlockChainNode struct {
-	Block    Block    // The block pointer
-	Children []string // hash block array of this block's children.
-	Height   int      // The height in the tree
-	InkTable InkTable // Stores the inks of each miner up to this block.
-	Canvas   Shapes   // All shapes on Canvas from Genesis to this block,
-	// not including side branches
-	// Key: Op hash
-	QueueShapes map[string]*QueueShape // All shapes in queue waiting to be validated by other blocks
-	// key: shape hash
-	// Operation log, storing all operations from Genesis to this block
-	// Usage: check no overlapped operations
-	OpLog map[string]*Op
+	Block           Block    // The block pointer
+	Children        []string // hash block array of this block's children.
+	Height          int      // The height in the tree
+	TotalWork       *big.Int // Cumulative proof of work from Genesis to this block
+	SeenOrder       uint64   // Order in which the block was added to the tree
+	DifficultyShift int      // Retarget adjustment to the configured difficulties of this block's children
+	ChainState               // Ink table, canvas, queued shapes and op log as of this block, owned by this node
 }
 
-// ---------------------------------------------------------------------
-// Global variables for blockchain
-// ---------------------------------------------------------------------
-// Hash tree that represents the blockchain data structure
-// Key: the Block's hash
-// Value: BlockChainNode pointer
-var treeTable map[string]*BlockChainNode
-
-// The block key to longest chain's leaf in treeTable
-// This is the block the miner extends.
-var longestLeafHash string
-
-// Operations queues to be added to block
-// Precondition: op is valid
-var opQueue map[string]*Op
-
-// Holds the blocks waiting to be disseminated once
-// miner is initialized
-var blockWaitQ []Block
-
-// Holds all blocks we can't recognize the prevHash of
-var noParentBlocks map[string]Block
-
 // ---------------------------------------------------------------------
 // ---------------------------------------------------------------------
 // ---------------------- Interface for art nodes ----------------------
@@ -84,8 +60,8 @@ var noParentBlocks map[string]Block
 // Returns the block hash of the genesis block.
 // Can return the following errors:
 // - DisconnectedError
-func GetGenesisBlockHash() (blockHash string, err error) {
-	hash := NetSettings.GenesisBlockHash
+func (e *Engine) GetGenesisBlockHash() (blockHash string, err error) {
+	hash := e.Settings.GenesisBlockHash
 	if hash == "" {
 		err = shared.DisconnectedError("genesis block hash not initialized")
 	}
@@ -95,9 +71,13 @@ func GetGenesisBlockHash() (blockHash string, err error) {
 // Retrieves the immediate children blocks of the block identified by blockHash.
 // Can return the following errors:
 // - InvalidBlockHashError
-func GetChildren(blockHash string) (blockHashes []string, err error) {
-	if treeBlock, exist := treeTable[blockHash]; exist {
-		blockHashes = treeBlock.Children
+func (e *Engine) GetChildren(blockHash string) (blockHashes []string, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if treeBlock, exist := e.treeTable[blockHash]; exist {
+		// Copy, the node's slice grows as children are added
+		blockHashes = append([]string{}, treeBlock.Children...)
 	} else {
 		err = shared.InvalidBlockHashError(blockHash)
 	}
@@ -107,8 +87,11 @@ func GetChildren(blockHash string) (blockHashes []string, err error) {
 // Retrieves the shapes in a block
 // Can return the following errors:
 // - InvalidBlockHashError
-func GetShapes(blockHash string) (shapeHashes []string, err error) {
-	bcNode, exists := treeTable[blockHash]
+func (e *Engine) GetShapes(blockHash string) (shapeHashes []string, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	bcNode, exists := e.treeTable[blockHash]
 	if !exists {
 		err = shared.InvalidBlockHashError(blockHash)
 		return
@@ -123,15 +106,18 @@ func GetShapes(blockHash string) (shapeHashes []string, err error) {
 // Retrieves the SVG string, fill, stroke of a shape in a comma separated list
 // Can return the following errors:
 // - InvalidShapeHashError
-func GetSVGFields(shapeHash string) (svg string, err error) {
-	op, exists := treeTable[longestLeafHash].OpLog[shapeHash]
+func (e *Engine) GetSVGFields(shapeHash string) (svg string, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	op, exists := e.treeTable[e.longestLeafHash].OpLog.Get(shapeHash)
 	if !exists {
 		err = shared.InvalidShapeHashError(shapeHash)
 		return
 	}
 
 	// Op exists, check if it's currently on canvas
-	minerCanvasPtr, existsOnCanvas := treeTable[longestLeafHash].Canvas[shapeHash]
+	minerCanvasPtr, existsOnCanvas := e.treeTable[e.longestLeafHash].Canvas.Get(shapeHash)
 	if existsOnCanvas {
 		return minerCanvasPtr.Shape.GetSVGFields(), nil
 	} else {
@@ -146,152 +132,190 @@ func GetSVGFields(shapeHash string) (svg string, err error) {
 
 }
 
-// Get the amount of ink held by the given public key
-func GetInk(pubKey string) uint32 {
-	ink, exists := treeTable[longestLeafHash].InkTable[pubKey]
+// Get the amount of ink held by the given public key that can be spent
+func (e *Engine) GetInk(pubKey string) uint32 {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	ink, exists := e.treeTable[e.longestLeafHash].InkTable[pubKey]
 	if !exists {
 		ink = 0
 	}
 	return ink
 }
 
+// Get the ink held by the given public key on the longest chain:
+// mature ink can be spent, pending ink was mined less than
+// RewardMaturity blocks ago
+func (e *Engine) GetInkBalance(pubKey string) shared.InkBalance {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	leaf := e.treeTable[e.longestLeafHash]
+	return shared.InkBalance{
+		Mature:  leaf.InkTable[pubKey],
+		Pending: leaf.ImmatureInk(pubKey),
+	}
+}
+
 // Adds a new shape to the block chain, stall until op is validated
 // validateNum: number of blocks needed after this block to validate this action
 // shape: shape to be added
+// fee: ink paid to the miner of the block holding the op
 // Checks for
 // - sufficient ink
 // - shape validity
-func AddShapeToBlockChain(validateNum uint8, shape Shape) (opHash string, blockHash string, inkRemaining uint32, err error) {
+func (e *Engine) AddShapeToBlockChain(validateNum uint8, shape Shape, fee uint32) (opHash string, blockHash string, inkRemaining uint32, err error) {
+	// The shape will extend the longest chain
+	ctx, err := e.NewValidationContext(e.LongestLeafHash())
+	if err != nil {
+		return
+	}
+
 	// Check for ink sufficiency
-	minerInk := treeTable[longestLeafHash].InkTable[PubKeyStr]
+	minerInk := ctx.State.InkTable[e.PubKeyStr]
 	shapeInk := ShapeInk(shape)
-	if shapeInk > minerInk {
+	if uint64(shapeInk)+uint64(fee) > uint64(minerInk) {
 		inkRemaining = minerInk
 		err = shared.InsufficientInkError(minerInk)
 		return
 	}
 
 	// Check shape validity
-	validated, err := ValidateShape(shape)
+	validated, err := ValidateShape(ctx, shape)
 	if !validated {
 		return
 	}
 
 	// Package given shape to an Op
-	r, s, err := ecdsa.Sign(rand.Reader, PrivKey, shape.HashToBytes())
-	if err != nil {
-		Log.Error("sign failure at add shape", err)
-		return
-	}
-	opSig := shared.OpenArgs{r, s}
 	op := Op{
 		Op:       shape,
-		OpSig:    opSig,
-		PubKey:   PubKeyStr,
+		PubKey:   e.PubKeyStr,
 		ValidNum: validateNum,
+		Fee:      fee,
 		Add:      true,
 	}
+	r, s, err := ecdsa.Sign(rand.Reader, e.PrivKey, op.SignedBytes())
+	if err != nil {
+		Log.Error("sign failure at add shape", err)
+		return
+	}
+	op.OpSig = shared.OpenArgs{r, s}
 
-	return AddOpToBlockChain(validateNum, op)
+	return e.AddOpToBlockChain(validateNum, op)
 }
 
-func AddOpToBlockChain(validateNum uint8, op Op) (opHash string, blockHash string, inkRemaining uint32, err error) {
+// Maximum time to wait for each block an op needs before and on top of it
+const confirmWaitPerBlock = 2 * time.Minute
+
+// Disseminate op and wait until it is confirmed at its ValidNum depth on the longest chain.
+// Returns the hash of the block holding the op.
+// Can return the following errors:
+// - ConfirmationTimeoutError, the op may still be confirmed later
+// - the op's validation error, if it is invalid or dropped in a reorg
+func (e *Engine) AddOpToBlockChain(validateNum uint8, op Op) (opHash string, blockHash string, inkRemaining uint32, err error) {
+	opHash = op.HashToString()
+
+	// Subscribe first, so no event about the op is missed
+	sub := e.Subscribe()
+	defer e.Unsubscribe(sub)
+
 	// Disseminate op to miner network
-	err = DisseminateOp(op)
+	err = e.DisseminateOp(op)
 	if err != nil {
 		Log.Error("invalid op", err)
 		return
 	}
 
-	// Sleep until shape is validated or timeout
-	tick := time.Tick(time.Duration(validateNum*5) * time.Second)
-	timeout := time.After(2 * time.Duration(validateNum) * time.Minute)
-	opHash = op.HashToString()
+	blockHash, err = e.waitForConfirmation(opHash, validateNum, sub)
+	inkRemaining = e.GetInk(e.PubKeyStr)
+	if err == nil {
+		Log.Trace("op confirmed:", op.Op.Svg, "add:", op.Add)
+		Log.Trace("ink remaining", inkRemaining)
+	}
+	return opHash, blockHash, inkRemaining, err
+}
+
+// Block until the op is confirmed on the longest chain, dropped from it,
+// or the deadline for validateNum blocks passes
+func (e *Engine) waitForConfirmation(opHash string, validateNum uint8, sub *Subscription) (blockHash string, err error) {
+	deadline := time.After((time.Duration(validateNum) + 1) * confirmWaitPerBlock)
+
+	// The op may have been confirmed by an earlier attempt
+	if blockHash, confirmed := e.OpConfirmation(opHash); confirmed {
+		return blockHash, nil
+	}
+
 	for {
 		select {
-		case <-tick:
-			// check if shape appears on the canvas of longest chain leaf
-			canvas := treeTable[longestLeafHash].Canvas
-
-			// Return if shape is on Canvas
-			if canvasPtr, ok := canvas[opHash]; ok {
-				inkTable := treeTable[longestLeafHash].InkTable
-				inkRemaining = inkTable[PubKeyStr]
-				Log.Trace("shape added to canvas:", canvasPtr.Shape.Svg)
-				Log.Trace("ink remaining", inkRemaining)
-
-				return opHash, canvasPtr.BlockHash, inkRemaining, nil
+		case event, ok := <-sub.Events:
+			if !ok {
+				// Fell behind, events were missed
+				e.Resubscribe(sub)
+				if blockHash, confirmed := e.OpConfirmation(opHash); confirmed {
+					return blockHash, nil
+				}
+				continue
+			}
+			if event.OpHash != opHash {
+				continue
+			}
+
+			switch event.Type {
+			case OpConfirmed:
+				return event.BlockHash, nil
+			case OpDropped:
+				Log.Debug("op [%s] dropped by reorg [%v]", opHash, event.Err)
+				return "", event.Err
 			}
-		case <-timeout:
-			// timeout, re-add the block
-			// TODO need to distinguish between the case where
-			// - other miners are adding to a separate branch, and the case where
-			// - it's just taking a long time to validate
-			Log.Debug("timeout, shape[%s], add[%t], validNum[%d]", op.Op.Svg, op.Add, validateNum)
-
-			return AddOpToBlockChain(validateNum, op)
-		default:
-			Log.Trace("sleep")
-			time.Sleep(time.Duration(validateNum*5) * time.Second)
+		case <-deadline:
+			Log.Debug("op [%s] not confirmed after [%d] blocks", opHash, validateNum)
+			return "", shared.ConfirmationTimeoutError(opHash)
 		}
 	}
-	return
 }
 
 // Removes a shape from the block chain. Inks are returned to the miner.
 // validateNum: number of blocks needed after this block to validate this action
 // shapeHash: hash of shape to be removed
+// The delete op is signed on its own and pays no fee.
 // Can return the following errors:
 // - DisconnectedError
-func DeleteShapeFromBlockChain(validateNum uint8, opHash string) (inkRemaining uint32, err error) {
+// - ConfirmationTimeoutError
+func (e *Engine) DeleteShapeFromBlockChain(validateNum uint8, opHash string) (inkRemaining uint32, err error) {
 	// need to check that shape exists and is removed by its owner
 	// Check that shape exists on canvas
-	shape, existsOnCanvas := treeTable[longestLeafHash].Canvas[opHash]
-	opPtr, existsOnOpLog := treeTable[longestLeafHash].OpLog[opHash]
-	inkRemaining = treeTable[longestLeafHash].InkTable[PubKeyStr]
+	e.lock.RLock()
+	leaf := e.treeTable[e.longestLeafHash]
+	shape, existsOnCanvas := leaf.Canvas.Get(opHash)
+	opPtr, existsOnOpLog := leaf.OpLog.Get(opHash)
+	inkRemaining = leaf.InkTable[e.PubKeyStr]
+	e.lock.RUnlock()
 
 	if existsOnCanvas && existsOnOpLog {
 		shapeOwner := shape.Shape.Owner
-		if shapeOwner != PubKeyStr {
+		if shapeOwner != e.PubKeyStr {
 			err = shared.ShapeOwnerError(shapeOwner)
 			return
 		}
 
-		// Convert op to Delete Op
-		add := false
-		op := SetOpAdd(*opPtr, add)
-
-		// Disseminate op to miner network
-		err = DisseminateOp(op)
-		if err != nil {
-			Log.Error("invalid op", err)
-			return inkRemaining, err
+		// Delete Op referring to the add op
+		op := Op{
+			Op:        opPtr.Op,
+			PubKey:    e.PubKeyStr,
+			ValidNum:  validateNum,
+			Add:       false,
+			AddOpHash: opHash,
 		}
-
-		// Sleep until shape is validated or timeout
-		tick := time.Tick(time.Duration(validateNum*5) * time.Second)
-		timeout := time.After(2 * time.Duration(validateNum) * time.Minute)
-		for {
-			select {
-			case <-tick:
-				// check if shape appears on the canvas of longest chain leaf
-				canvas := treeTable[longestLeafHash].Canvas
-
-				// Return if shape is no longer on Canvas
-				if _, ok := canvas[opHash]; !ok {
-					inkTable := treeTable[longestLeafHash].InkTable
-					inkRemaining = inkTable[PubKeyStr]
-					return inkRemaining, nil
-				}
-			case <-timeout:
-				// timeout, re-add the block
-				Log.Trace("timeout", shape, validateNum)
-				return DeleteShapeFromBlockChain(validateNum, opHash)
-			default:
-				time.Sleep(time.Duration(validateNum*5) * time.Second)
-			}
+		r, s, signErr := ecdsa.Sign(rand.Reader, e.PrivKey, op.SignedBytes())
+		if signErr != nil {
+			Log.Error("sign failure at delete shape", signErr)
+			return inkRemaining, signErr
 		}
+		op.OpSig = shared.OpenArgs{r, s}
 
+		_, _, inkRemaining, err = e.AddOpToBlockChain(validateNum, op)
+		return inkRemaining, err
 	} else {
 		err = shared.InvalidShapeHashError(opHash)
 	}
@@ -308,102 +332,110 @@ func DeleteShapeFromBlockChain(validateNum uint8, opHash string) (inkRemaining u
 // ---------------------------------------------------------------------
 // Blockchain initialization
 // ---------------------------------------------------------------------
-// InitBlockchain is called after NetSetting is set
-func InitBlockchain() (error, chan bool) {
-	// Initialize global variables
-	treeTable = make(map[string]*BlockChainNode)
-	longestLeafHash = NetSettings.GenesisBlockHash
-	opQueue = make(map[string]*Op)
-	done := make(chan bool)
-	blockWaitQ = make([]Block, 0)
-	noParentBlocks = make(map[string]Block)
-
-	// Add Genesis block to tree table
-	GenesisNode := BlockChainNode{
-		Block:       NoOpBlock{},
-		Children:    []string{},
-		Height:      0,
-		InkTable:    make(InkTable),
-		Canvas:      make(Shapes),
-		QueueShapes: make(map[string]*QueueShape),
-		OpLog:       make(map[string]*Op),
-	}
-	treeTable[longestLeafHash] = &GenesisNode
-
-	// Validate each block and add it to treeTable
-	longestChain := GetNetworkBlockchain()
-	for _, block := range longestChain {
-		blockHashStr := block.Hash()
-		if _, ok := treeTable[blockHashStr]; !ok {
-			// Check Block is valid before disseminating
-			validated, err := ValidateBlock(block)
-			if !validated || err != nil {
-				Log.Error("initialization block error [%s], [%s]", blockHashStr, err.Error())
-				return err, done
-			}
-
-			// Add to our own block chain
-			AddBlockToBlockchain(block)
+// InitBlockchain restores the stored blocks, syncs with the neighbours
+// and starts mining
+func (e *Engine) InitBlockchain() (err error, done chan bool) {
+	done = make(chan bool)
+
+	// Reload the blocks persisted by a previous run
+	e.lock.Lock()
+	e.blockStore, err = OpenBlockStore(e.DataDir)
+	if err != nil {
+		e.lock.Unlock()
+		Log.Error("failed to open block store [%s]", err.Error())
+		return err, done
+	}
+	storedChain, err := e.blockStore.Load()
+	if err != nil {
+		e.lock.Unlock()
+		Log.Error("failed to load block store [%s]", err.Error())
+		return err, done
+	}
+	for _, block := range storedChain {
+		// Already validated before being stored, but the store is
+		// not trusted to be intact
+		validated, err := e.validateBlock(block)
+		if !validated || err != nil {
+			Log.Error("skipping stored block [%s], [%v]", block.Hash(), err)
+			continue
 		}
+		e.addBlockToTree(block)
 	}
-
-	// start mining
-	go Mine()
-
-	// dequeue some blocks
-	go dequeueBlocks()
+	restoredLeafHash := e.longestLeafHash
+	e.lock.Unlock()
+	Log.Debug("Restored [%d] blocks from [%s], longest leaf [%s]", len(storedChain), e.DataDir, restoredLeafHash)
+
+	// Only fetch the blocks mined since our restored leaf,
+	// or since Genesis for a new miner
+	e.SyncWithNetwork()
+
+	// From now on DisseminateBlock adds blocks directly, take the ones
+	// that arrived while initializing
+	e.lock.Lock()
+	e.initialized = true
+	blockWaitQ := e.blockWaitQ
+	e.blockWaitQ = nil
+	// Counted under the lock, so Stop waits for the loops it lets start
+	stopped := e.stopped
+	if !stopped {
+		e.loops.Add(2)
+	}
+	e.lock.Unlock()
 
 	// Add blocks temporarily held off while waiting for initialization
-	for len(blockWaitQ) > 0 {
-		blockWaitQCpy := blockWaitQ
-		for _, block := range blockWaitQCpy {
-			DisseminateBlockForce(block)
-		}
+	for _, block := range blockWaitQ {
+		e.DisseminateBlockForce(block)
+	}
 
-		if len(blockWaitQ) > len(blockWaitQCpy) {
-			blockWaitQ = blockWaitQ[len(blockWaitQCpy):]
-		}
+	if stopped {
+		return nil, done
 	}
 
-	initialized = true
+	// start mining, until Stop
+	go func() {
+		defer e.loops.Done()
+		e.Mine()
+	}()
+
+	// dequeue some blocks
+	go func() {
+		defer e.loops.Done()
+		e.dequeueBlocks()
+	}()
+
 	Log.Debug("BLOCKCHAIN INITIALIZED")
 
 	return nil, done
 
 }
 
-// Periodicially ask for blocks we are missing from neighbours
-func dequeueBlocks() {
-	for hash, block := range noParentBlocks {
-		// Check if we can already disseminate a block in the queue
-		if _, exists := treeTable[block.GetPrevHash()]; exists {
-			DisseminateBlockForce(block)
-			delete(noParentBlocks, hash) // remove from queue
-		} else {
-			// Else call our neighbours to see if they have the block
-			parent := new(Block)
-			for _, conn := range ActiveNeighbours {
-				err := conn.Call("MinerMinerRPC.GetBlockFromHash", block.GetPrevHash(), parent)
-				if err == nil && parent != nil {
-					Log.Debug("Found block. Trying to disseminate now [%v]", parent)
-					DisseminateBlockForce(*parent)
-					DisseminateBlockForce(block)
-					delete(noParentBlocks, hash)
-					break
-				}
-			}
-		}
-	}
-	time.Sleep(5000 * time.Millisecond)
+// Return the hash of the block the miner extends
+func (e *Engine) LongestLeafHash() string {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.longestLeafHash
+}
+
+// Return true if the block is in the tree
+func (e *Engine) HasBlock(blockHash string) bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	_, exists := e.treeTable[blockHash]
+	return exists
 }
 
 // Return the longest chain, excluding side branches and genesis block
 // Array order [Genesis+1Node, ... , leaf]
-func GetLongestChain() []Block {
+func (e *Engine) GetLongestChain() []Block {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
 	var chain RawBlockchain
-	if initialized {
-		var currentBlockHash = longestLeafHash
-		GenesisHash, err := GetGenesisBlockHash()
+	if e.initialized {
+		var currentBlockHash = e.longestLeafHash
+		GenesisHash, err := e.GetGenesisBlockHash()
 		if err != nil {
 			panic("genesis hash not initialized")
 		}
@@ -411,7 +443,7 @@ func GetLongestChain() []Block {
 		// starting from leaf, working upward to Genesis block (root)
 		// Insert element to fron of array
 		for currentBlockHash != GenesisHash {
-			block := treeTable[currentBlockHash].Block
+			block := e.treeTable[currentBlockHash].Block
 			blockHolder := make([]Block, 1)
 			blockHolder[0] = block
 			chain = append(blockHolder, chain...)
@@ -428,203 +460,242 @@ func GetLongestChain() []Block {
 // Disseminate Op to other miners in the network.
 // Check that an operation with an identical signature has not been
 // previously added to the blockchain
-func DisseminateOp(op Op) (err error) {
+func (e *Engine) DisseminateOp(op Op) (err error) {
 	Log.Debug("Disseminate op: [%s], AddShape:[%t], validNum:[%d]", op.Op.Svg, op.Add, op.ValidNum)
+	queued, err := e.queueOp(op)
+	if queued {
+		// broadcast to network, outside the lock
+		e.FloodMinerNetworkOp(op)
+	}
+	return err
+}
+
+// Add op to opQueue if it is new and valid on the longest chain
+// Return true if the op was added
+func (e *Engine) queueOp(op Op) (queued bool, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
 	// If op is not in the queue yet
 	// prevent neighbour flood-back infinite loop
 	// prevents operation replay attacks
 	opHashStr := op.HashToString()
-	_, existInLog := treeTable[longestLeafHash].OpLog[opHashStr]
-	_, existInQueue := opQueue[opHashStr]
+	_, existInLog := e.treeTable[e.longestLeafHash].OpLog.Get(opHashStr)
+	_, existInQueue := e.opQueue[opHashStr]
 
 	// Disseminate op only if it doesn't already exist in queue or the chain's log
-	if !existInLog && !existInQueue {
-		// Check Op is valid before disseminating
-		validated, err := ValidateOp(op)
-		if !validated || err != nil {
-			Log.Error("disseminate op [%v] error [%s]", op, err.Error())
-			return err
-		}
+	if existInLog || existInQueue {
+		Log.Debug("Do not re-add Op to mining queue op hash: [%s]", opHashStr)
+		return false, nil
+	}
+
+	// Check Op is valid before disseminating
+	// The op will be mined on top of the longest chain
+	ctx, err := e.newValidationContext(e.longestLeafHash)
+	if err != nil {
+		return false, err
+	}
+	validated, err := ValidateOp(ctx, op)
+	if !validated || err != nil {
+		Log.Error("disseminate op [%v] error [%v]", op, err)
+		return false, err
+	}
 
-		// add op to opQueue
-		opQueue[opHashStr] = &op
+	// add op to opQueue, and mine it right away
+	e.enqueueOp(opHashStr, op)
+	e.interruptMining()
+	return true, nil
+}
 
-		// broadcast to network
-		FloodMinerNetworkOp(op)
-	} else {
-		Log.Debug("Do not re-add Op to mining queue op hash: [%s]", opHashStr)
+// Add op to opQueue, behind the ops already queued
+// Precondition: e.lock is held for writing
+func (e *Engine) enqueueOp(opHash string, op Op) {
+	e.arrivalCount++
+	e.opQueue[opHash] = &op
+	e.opArrival[opHash] = e.arrivalCount
+}
+
+// Return the op in opQueue with the given hash
+func (e *Engine) GetQueuedOp(opHash string) (op Op, queued bool) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if queuedOp, queued := e.opQueue[opHash]; queued {
+		return *queuedOp, true
 	}
+	return op, false
+}
 
-	return err
+// Remove op from opQueue
+// Precondition: e.lock is held for writing
+func (e *Engine) dequeueOp(opHash string) {
+	delete(e.opQueue, opHash)
+	delete(e.opArrival, opHash)
 }
 
-func DisseminateBlock(block Block) (err error) {
-	if !initialized {
-		blockWaitQ = append(blockWaitQ, block)
+// Return the hashes of the queued ops, in the order set by OpOrderPolicy:
+// the order they arrived, or the highest fee first
+// Precondition: e.lock is held, at least for reading
+func (e *Engine) queuedOpHashes() (opHashes []string) {
+	for opHash := range e.opQueue {
+		opHashes = append(opHashes, opHash)
+	}
+	sort.Slice(opHashes, func(i, j int) bool {
+		if e.Settings.OpOrderPolicy == OpOrderFee {
+			feeI, feeJ := e.opQueue[opHashes[i]].Fee, e.opQueue[opHashes[j]].Fee
+			if feeI != feeJ {
+				return feeI > feeJ
+			}
+		}
+		return e.opArrival[opHashes[i]] < e.opArrival[opHashes[j]]
+	})
+	return opHashes
+}
+
+// Disseminate a block from an unknown sender, once the miner is initialized
+func (e *Engine) DisseminateBlock(block Block) (err error) {
+	return e.disseminateBlockFrom(block, "")
+}
+
+// Same as DisseminateBlock, for a block sent by the neighbour with the
+// given public key
+func (e *Engine) disseminateBlockFrom(block Block, peer string) (err error) {
+	e.lock.Lock()
+	if !e.initialized {
+		e.blockWaitQ = append(e.blockWaitQ, block)
+		e.lock.Unlock()
 		return
 	}
-	return disseminateBlock(block)
+	e.lock.Unlock()
+	return e.disseminateBlock(block, peer)
 }
 
-func DisseminateBlockForce(block Block) (err error) {
-	return disseminateBlock(block)
+func (e *Engine) DisseminateBlockForce(block Block) (err error) {
+	return e.disseminateBlock(block, "")
 }
 
 // Disseminate block that is successfully mined to other miners in the network
 // - do not call directly (called by DisseminateBlock(Forced))
-func disseminateBlock(block Block) (err error) {
+func (e *Engine) disseminateBlock(block Block, peer string) (err error) {
 	// Only disseminate block if block is not in the chain yet
 	// (prevent neighbour flood-back infinite loop)
-	blockHashStr := block.Hash()
-	if _, ok := treeTable[blockHashStr]; !ok {
-
-		// Check Block is valid before disseminating
-		validated, err := ValidateBlock(block)
-		if !validated || err != nil {
-			Log.Error("Disseminate block validation error [%s]", err)
-			return err
-		}
-
-		// Add to our own block chain
-		AddBlockToBlockchain(block)
+	added, err := e.addBlockIfNew(block, peer)
+	if err != nil {
+		Log.Error("Disseminate block validation error [%s]", err)
+	}
 
-		// broadcast to network
-		FloodMinerNetworkBlock(block)
+	// broadcast to network, outside the lock
+	for _, block := range added {
+		e.FloodMinerNetworkBlock(block)
 	}
 
 	return err
 }
 
-// Precondition: block is valid
-// Add block to block chain if block is valid
-// If block is successfully added, ancestors of the block's ValidNum in QueueShapes is decremented by one
-func AddBlockToBlockchain(block Block) {
-	validated, err := ValidateBlock(block)
-	if !validated || err != nil {
-		Log.Error("Panic: invariant violated, block is not valid [%v]", err)
+// Validate block and add it to the block chain, unless it is already there,
+// followed by the orphans waiting for it.
+// A block whose parent is not in the tree goes to the orphans, sent by peer.
+// Return the blocks added
+func (e *Engine) addBlockIfNew(block Block, peer string) (added []Block, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if _, ok := e.treeTable[block.Hash()]; ok {
+		return nil, nil
 	}
 
-	blockHash := block.Hash()
-	previousBlockHash := block.GetPrevHash()
+	// Not the block its hash stands for, see checkDuplicateOps
+	if err = checkDuplicateOps(block.GetOps()); err != nil {
+		return nil, err
+	}
 
-	// Update previous block to have this block as its child
-	treeTable[previousBlockHash].Children = append(treeTable[previousBlockHash].Children, blockHash)
-	previousBlock := treeTable[previousBlockHash]
+	// The parent may still arrive, or be fetched, see fetchOrphanAncestors
+	if _, parentExists := e.treeTable[block.GetPrevHash()]; !parentExists {
+		// Blocks of unknown senders share a quota: only ones with a proof
+		// of work may take a slot
+		if !e.pow.Verify(block.Header(), e.orphanDifficulty(isOpBlock(block))) {
+			return nil, shared.InvalidBlockHashError("invalid nonce in block without parent " + block.Hash())
+		}
+		e.orphans.add(block, peer, time.Now())
+		return nil, shared.InvalidBlockHashError("previous block pointer is not in blockchain")
+	}
 
-	// Update canvas and queueShapes
-	canvas := previousBlock.Canvas
-	queueShapes := previousBlock.QueueShapes
+	// Check Block is valid before adding
+	validated, err := e.validateBlock(block)
+	if !validated || err != nil {
+		return nil, err
+	}
 
-	for key, _ := range queueShapes {
-		queueShapes[key].ValidNum--
-		if queueShapes[key].ValidNum > 0 {
-			// Do nothing
-		} else {
-			// Add/Delete the shape to/from Canvas
-			shape := queueShapes[key].Shape
-			if queueShapes[key].Add {
-				minerCanvas := MinerCanvas{
-					Shape:     shape,
-					BlockHash: queueShapes[key].BlockHash,
-				}
-				canvas[key] = &minerCanvas
-			} else {
-				// Retrieve key for op's add hash from opLog
-				deleteOp := treeTable[longestLeafHash].OpLog[key]
-				addOp := SetOpAdd(*deleteOp, true)
-				delete(canvas, addOp.HashToString())
-			}
+	e.addBlockToBlockchain(block)
+	return append([]Block{block}, e.connectOrphans(block.Hash())...), nil
+}
 
-			// Delete from qeueShape, it's reached valid num
-			delete(queueShapes, key)
+// Precondition: block is valid
+// Add block to block chain and persist it to the block store
+func (e *Engine) AddBlockToBlockchain(block Block) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
 
-		}
+	e.addBlockToBlockchain(block)
+}
+
+// Same as AddBlockToBlockchain, with e.lock held
+func (e *Engine) addBlockToBlockchain(block Block) {
+	validated, err := e.validateBlock(block)
+	if !validated || err != nil {
+		Log.Error("Panic: invariant violated, block is not valid [%v]", err)
 	}
 
-	opLog := previousBlock.OpLog
-	inkTable := previousBlock.InkTable
-	minerPubKey := block.GetMinerPubKey()
-	if _, ok := inkTable[minerPubKey]; !ok {
-		// Add first ink table entry
-		inkTable[minerPubKey] = 0
-	}
-	minerPubKeySuffix := minerPubKey[len(minerPubKey)-10:]
-	switch block.(type) {
-	case OpBlock:
-		// Reward miner of mining a OpBlock
-		inkTable[minerPubKey] += NetSettings.InkPerOpBlock
-
-		// Loop through ops to perform chain logistics
-		// ink transactions, opLog update, queueShapes updates
-		for _, op := range block.GetOps() {
-			Log.Debug("Op[%s] in Block[%s] queued for validation", op.HashToString(), block.Hash())
-
-			// add current ops to queue shapes
-			qs := QueueShape{
-				Shape:     op.Op,
-				ValidNum:  op.ValidNum,
-				Add:       op.Add,
-				BlockHash: block.Hash(),
-			}
-			queueShapes[op.HashToString()] = &qs
+	err = e.blockStore.Append(block)
+	if err != nil {
+		Log.Error("failed to persist block [%s] [%s]", block.Hash(), err.Error())
+	}
 
-			// Add op to log
-			opLog[op.HashToString()] = &op
+	e.addBlockToTree(block)
+}
 
-			// delete them from opQueue
-			delete(opQueue, op.HashToString())
+// Precondition: block is valid, e.lock is held
+// Add block to the tree table without persisting it
+// If block is successfully added, ancestors of the block's ValidNum in QueueShapes is decremented by one
+func (e *Engine) addBlockToTree(block Block) {
+	blockHash := block.Hash()
+	previousBlockHash := block.GetPrevHash()
 
-			// reflect Ops cost
-			cost := ShapeInk(op.Op)
-			if op.Add {
-				inkTable[op.PubKey] -= cost
-			} else {
-				inkTable[op.PubKey] += cost
-			}
-			Log.Debug("Add OpBlock. Ink: [%d], Miner Suffix:[%s]", inkTable[minerPubKey], minerPubKeySuffix)
-		}
-	case NoOpBlock:
-		// Reward miner of mining a NoOpBlock
-		inkTable[minerPubKey] += NetSettings.InkPerNoOpBlock
-		Log.Debug("Add NoOpBlock. Ink: [%d], Miner Suffix:[%s]", inkTable[minerPubKey], minerPubKeySuffix)
-	default:
-		// Invariant check
-		Log.Error("Panic: this is not a valid block")
-	}
+	// Update previous block to have this block as its child
+	e.treeTable[previousBlockHash].Children = append(e.treeTable[previousBlockHash].Children, blockHash)
+	previousBlock := e.treeTable[previousBlockHash]
+
+	// Apply the block to a copy of the parent's state,
+	// the parent and its other children keep their own state
+	state := previousBlock.ChainState.Copy()
+	state.applyBlock(block, e.Settings)
+	state.compact()
 
 	// Package into a block chain tree
+	e.seenCounter++
+	height := previousBlock.Height + 1
 	bct := BlockChainNode{
-		Block:       block,
-		Children:    make([]string, 0),
-		Height:      previousBlock.Height + 1,
-		InkTable:    inkTable,
-		Canvas:      canvas,
-		QueueShapes: queueShapes,
-		OpLog:       opLog,
+		Block:           block,
+		Children:        make([]string, 0),
+		Height:          height,
+		TotalWork:       ChainWork(previousBlock, e.powDifficulty(previousBlockHash, isOpBlock(block))),
+		SeenOrder:       e.seenCounter,
+		DifficultyShift: e.difficultyShift(previousBlock, block, height),
+		ChainState:      state,
 	}
 
-	treeTable[blockHash] = &bct
+	e.treeTable[blockHash] = &bct
 
 	// update the longestLeafHash
-	longestLeafHeight := treeTable[longestLeafHash].Height
-	if bct.Height > longestLeafHeight {
-		Log.Debug("newHash [%s], oldHash [%s], old len [%d],  new len [%d]",
-			block.Hash(), longestLeafHash, longestLeafHeight, bct.Height)
-
-		longestLeafHash = block.Hash()
-	} else if bct.Height == longestLeafHeight {
-		// Randomly chooses one as the longest leaf
-		if shared.RandomNumGenerator()%2 == 0 {
-			// Debugging
-			Log.Debug("Switching to new branch in blockchain, oldHash[%s], oldChain len [%d], new hash [%s], newChain len [%d]", longestLeafHash, longestLeafHeight, block.Hash(), bct.Height)
-
-			longestLeafHash = block.Hash()
+	longestLeaf := e.treeTable[e.longestLeafHash]
+	if e.Settings.ForkChoicePolicy.BetterTip(&bct, longestLeaf) {
+		Log.Debug("newHash [%s], oldHash [%s], old work [%s], new work [%s], old len [%d],  new len [%d]",
+			blockHash, e.longestLeafHash, longestLeaf.TotalWork, bct.TotalWork, longestLeaf.Height, bct.Height)
 
-		}
+		e.setLongestLeaf(blockHash)
 	} else {
-		Log.Debug("Adding a new node to non-longest side chain: blockhash [%s], longestChainLen [%s], currChainLength [%d]", blockHash, longestLeafHash, previousBlock.Height+1)
+		Log.Debug("Adding a new node to non-longest side chain: blockhash [%s], longestLeafHash [%s], currChainLength [%d]", blockHash, e.longestLeafHash, bct.Height)
 	}
-
 }
 
 // Validate the block received from other miners
@@ -633,79 +704,191 @@ func AddBlockToBlockchain(block Block) {
 // - the previous block hash points to a legal, previously generated, block.
 // - each operation in the block is valid
 // Return false otherwise. (with reason stated in err)
-func ValidateBlock(block Block) (validated bool, err error) {
+func (e *Engine) ValidateBlock(block Block) (validated bool, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.validateBlock(block)
+}
+
+// Same as ValidateBlock, with e.lock held
+func (e *Engine) validateBlock(block Block) (validated bool, err error) {
+	// The version decides how the block is hashed, check it first
+	if block.GetVersion() != e.Settings.BlockVersion {
+		return false, shared.InvalidBlockHashError("unexpected block version " + strconv.Itoa(int(block.GetVersion())))
+	}
+
+	// Check the block is not too big to validate and transmit
+	if err = e.checkBlockLimits(block.GetOps()); err != nil {
+		return false, err
+	}
+	if err = checkDuplicateOps(block.GetOps()); err != nil {
+		return false, err
+	}
+
+	// Check previous block exists in blockchain,
+	// the difficulty and timestamp depend on its history
+	_, previousBlockExists := e.treeTable[block.GetPrevHash()]
+	if !previousBlockExists {
+		return false, shared.InvalidBlockHashError("previous block pointer is not in blockchain")
+	}
+
 	// Verify nonce is valid
-	validated = ZeroPrefix(block)
+	validated = e.pow.Verify(block.Header(), e.powDifficulty(block.GetPrevHash(), isOpBlock(block)))
 	if !validated {
 		return false, shared.InvalidBlockHashError("invalid nonce")
 	}
 
-	// Check previous block exists in blockchain
-	_, previousBlockExists := treeTable[block.GetPrevHash()]
-	if !previousBlockExists {
-		// Add the block to the queue
-		noParentBlocks[block.Hash()] = block
-		return false, shared.InvalidBlockHashError("previous block pointer is not in blockchain")
+	// Verify the block is not older than its ancestors or from the future
+	if !e.validTimestamp(block) {
+		return false, shared.InvalidBlockHashError("invalid timestamp")
 	}
 
-	// Check each operation in block is valid
+	// Check each operation in block is valid against the history the block extends
+	ctx, err := e.newValidationContext(block.GetPrevHash())
+	if err != nil {
+		return false, err
+	}
+	// Ops are applied in order, so together they can't overspend or overlap
 	ops := block.GetOps()
 	for _, op := range ops {
-		validated, err = ValidateOp(op)
+		validated, err = ValidateOp(ctx, op)
 		if !validated || err != nil {
 			return validated, err
 		}
+		ctx.ApplyOp(op)
 	}
 
 	return validated, err
 }
 
-// Validate an op received from other miners
+// State that blocks and ops are validated against:
+// the history from Genesis up to and including ParentHash,
+// followed by the ops applied so far in the block being validated
+type ValidationContext struct {
+	ParentHash     string
+	State          ChainState // scratch copy of the parent's state
+	Pending        Shapes     // shapes added by the ops applied so far
+	CanvasSettings shared.CanvasSettings
+	Version        shared.BlockVersion // version the op's shape must be hashed with
+}
+
+// Return the context to validate a block or op that extends parentHash
+// Can return the following errors:
+// - InvalidBlockHashError
+func (e *Engine) NewValidationContext(parentHash string) (ctx *ValidationContext, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.newValidationContext(parentHash)
+}
+
+// Same as NewValidationContext, with e.lock held
+func (e *Engine) newValidationContext(parentHash string) (ctx *ValidationContext, err error) {
+	parent, exists := e.treeTable[parentHash]
+	if !exists {
+		return nil, shared.InvalidBlockHashError(parentHash)
+	}
+
+	ctx = &ValidationContext{
+		ParentHash:     parentHash,
+		State:          parent.ChainState.Copy(),
+		Pending:        make(Shapes),
+		CanvasSettings: e.Settings.CanvasSettings,
+		Version:        e.Settings.BlockVersion,
+	}
+	return ctx, nil
+}
+
+// Apply a validated op to the scratch state, so the ops after it in the
+// same block see its ink debit and the shape it adds.
+// Mirrors what applyBlock does with the op once the block is added.
+func (ctx *ValidationContext) ApplyOp(op Op) {
+	opHash := op.HashToString()
+
+	cost := ShapeInk(op.Op)
+	if op.Add {
+		ctx.State.InkTable[op.PubKey] -= cost
+		ctx.Pending[opHash] = &MinerCanvas{Shape: op.Op}
+	} else {
+		ctx.State.InkTable[op.PubKey] += cost
+	}
+	// The fee is only credited to the miner once the block is applied
+	ctx.State.InkTable[op.PubKey] -= op.Fee
+
+	ctx.State.QueueShapes[opHash] = &QueueShape{
+		Shape:    op.Op,
+		ValidNum: op.ValidNum,
+		Add:      op.Add,
+	}
+	ctx.State.OpLog.add(opHash, &op)
+}
+
+// Validate an op against the state in ctx
 // Return true if:
-// - the operation has a valid signature
-// - the operation has sufficient ink associated with the public key that generated the operation
+// - the operation is hashed with the chain's block version
+// - the operation has a valid signature, covering its ValidNum and fee, and for a delete op the add op it deletes
+// - the operation has sufficient ink associated with the public key that generated the operation, for its shape and fee
 // - the operation does not violate the shape intersection policy
-// - an operation that deletes a shape refers to a shape that exists and which has not been previously deleted.
+// - an operation that deletes a shape refers to a shape that exists, was added by the same key and which has not been previously deleted.
+// - the operation has not been previously added to the history in ctx
 // Return false otherwise. (with reason stated in err)
-func ValidateOp(op Op) (validated bool, err error) {
+func ValidateOp(ctx *ValidationContext, op Op) (validated bool, err error) {
+	// Verify the op is hashed the way the chain's blocks are
+	if op.Op.Version != ctx.Version {
+		return false, shared.InvalidShapeHashError("op hashed with another block version")
+	}
+
 	// Verify signature
 	opPubKey, err := shared.DecodePubKey(op.PubKey)
 	if err != nil {
 		Log.Error("decode pubkey from str failed", err)
 		return false, errors.New("decode pubkey from str failed")
 	}
-	validated = ecdsa.Verify(opPubKey, op.Op.HashToBytes(), op.OpSig.R, op.OpSig.S)
+	validated = ecdsa.Verify(opPubKey, op.SignedBytes(), op.OpSig.R, op.OpSig.S)
 	if !validated {
 		return validated, shared.InvalidShapeHashError("shape hash not signed by provided pub key")
 	}
 
+	// Verify op is not a replay
+	if _, existsInLog := ctx.State.OpLog.Get(op.HashToString()); existsInLog {
+		return false, shared.InvalidShapeHashError("op was previously added to the chain")
+	}
+
+	// Verify sufficient ink
+	minerInk := ctx.State.InkTable[op.PubKey]
+	opCost := uint64(op.Fee)
+	if op.Add {
+		opCost += uint64(ShapeInk(op.Op))
+	}
+	if opCost > uint64(minerInk) {
+		return false, shared.InsufficientInkError(minerInk)
+	}
+
 	if op.Add {
-		// Verify sufficient ink
-		minerInk := treeTable[longestLeafHash].InkTable[op.PubKey]
-		opCost := ShapeInk(op.Op)
-		if opCost > minerInk {
-			return false, shared.InsufficientInkError(minerInk)
-		}
 
 		// Verify validity of adding shape
-		validated, err = ValidateShape(op.Op)
+		validated, err = ValidateShape(ctx, op.Op)
 		if !validated {
 			return validated, err
 		}
 
 	} else {
 		// Verify delete shape exists on canvas
-		add := true
-		addOp := SetOpAdd(op, add)
-		_, shapeExistsOnCanvas := treeTable[longestLeafHash].Canvas[addOp.HashToString()]
-		if !shapeExistsOnCanvas {
+		addOp, existsInLog := ctx.State.OpLog.Get(op.AddOpHash)
+		_, shapeExistsOnCanvas := ctx.State.Canvas.Get(op.AddOpHash)
+		if !existsInLog || !shapeExistsOnCanvas {
 			return false, shared.ShapeOwnerError("shape doesn't exist on canvas")
 		}
 
+		// Verify the shape is deleted by the key that added it, and its ink is refunded
+		if addOp.PubKey != op.PubKey || !bytes.Equal(addOp.Op.HashToBytes(), op.Op.HashToBytes()) {
+			return false, shared.ShapeOwnerError(addOp.PubKey)
+		}
+
 		// Verify shape hasn't been previously deleted
-		shapeQueue, shapeExistsInQueue := treeTable[longestLeafHash].QueueShapes[op.HashToString()]
-		if shapeExistsInQueue {
-			if !shapeQueue.Add {
+		for opHash, shapeQueue := range ctx.State.QueueShapes {
+			if queuedOp, _ := ctx.State.OpLog.Get(opHash); !shapeQueue.Add && queuedOp.AddOpHash == op.AddOpHash {
 				return false, errors.New("shape was in queue to be deleted")
 			}
 		}
@@ -716,8 +899,11 @@ func ValidateOp(op Op) (validated bool, err error) {
 }
 
 // Return nil if block doesn't exist
-func GetBlock(blockHash string) (block Block, err error) {
-	blockNode, exist := treeTable[blockHash]
+func (e *Engine) GetBlock(blockHash string) (block Block, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	blockNode, exist := e.treeTable[blockHash]
 	if exist {
 		block = blockNode.Block
 	} else {
@@ -731,19 +917,21 @@ func GetBlock(blockHash string) (block Block, err error) {
 // Shapes bridging calls to miner-art
 // ---------------------------------------------------------------------
 
-// Calls shape's validate
-func ValidateShape(shape Shape) (validated bool, err error) {
+// Calls shape's validate against the canvas in ctx,
+// including the shapes pending in the same block
+func ValidateShape(ctx *ValidationContext, shape Shape) (validated bool, err error) {
 	var shapes = make(map[string]Shape)
-	latestShapesOnCanvas := treeTable[longestLeafHash].Canvas
-
-	for key, canvasPtr := range latestShapesOnCanvas {
+	ctx.State.Canvas.Each(func(key string, canvasPtr *MinerCanvas) {
+		shapes[key] = canvasPtr.Shape
+	})
+	for key, canvasPtr := range ctx.Pending {
 		shapes[key] = canvasPtr.Shape
 	}
 
 	canvas := Canvas{
 		Shapes: shapes,
-		XMax:   NetSettings.CanvasSettings.CanvasXMax,
-		YMax:   NetSettings.CanvasSettings.CanvasYMax,
+		XMax:   ctx.CanvasSettings.CanvasXMax,
+		YMax:   ctx.CanvasSettings.CanvasYMax,
 	}
 
 	Log.Debug("validating shape [%s], canvas size [%d]", shape.Svg, len(canvas.Shapes))
@@ -763,109 +951,147 @@ func ShapeInk(shape Shape) (cost uint32) {
 // Local Mining
 // ---------------------------------------------------------------------
 
-// Find the nonce for the given block data
-// Output same block with the nonce field set
-// If it cannot find nonce within timeout, it returns nil
-func FindNonce(block Block) Block {
-
-	var (
-		opBlk           OpBlock
-		noOpBlk         NoOpBlock
-		isOpBlk         bool = false
-		timeOutDuration time.Duration
-	)
-
-	switch block.(type) {
-	case OpBlock:
-		opBlk = block.(OpBlock)
-		isOpBlk = true
-		timeOutDuration = time.Duration(NetSettings.PoWDifficultyOpBlock * 25)
-	case NoOpBlock:
-		noOpBlk = block.(NoOpBlock)
-		timeOutDuration = time.Duration(NetSettings.PoWDifficultyNoOpBlock * 25)
-	default:
-		Log.Error("unsupported Block type")
-	}
-
-	// Set time, once ticked, give up current task and work on new block
-	// Prevent wasting time
-	timeout := time.After(timeOutDuration * time.Second)
+// Return the queued ops that can go in one block extending previousHash,
+// in OpOrderPolicy order, up to the MaxOpsPerBlock and MaxBlockBytes limits.
+// Ops are validated cumulatively, the same way ValidateBlock checks them,
+// so an op that conflicts with an op already picked, or that doesn't fit,
+// is left in the queue for a later block.
+// Precondition: e.lock is held, at least for reading
+func (e *Engine) selectOps(previousHash string) (ops []Op) {
+	ctx, err := e.newValidationContext(previousHash)
+	if err != nil {
+		Log.Error("cannot mine on [%s] [%s]", previousHash, err.Error())
+		return
+	}
 
-	for {
-		select {
-		case <-timeout:
-			return nil
-		default:
-			// Generate random nonce
-			nonce := shared.RandomNumGenerator()
-
-			if isOpBlk {
-				opBlk.Nonce = nonce
-				if ZeroPrefix(opBlk) {
-					return opBlk
-				}
-			} else {
-				noOpBlk.Nonce = nonce
-				if ZeroPrefix(noOpBlk) {
-					return noOpBlk
-				}
-			}
+	maxOps := int(e.Settings.MaxOpsPerBlock)
+	maxBytes := int(e.Settings.MaxBlockBytes)
+	blockBytes := 0
+	for _, opHash := range e.queuedOpHashes() {
+		if maxOps > 0 && len(ops) == maxOps {
+			break
+		}
+		op := *e.opQueue[opHash]
+
+		// A smaller op queued later may still fit
+		opBytes := OpSize(op)
+		if maxBytes > 0 && blockBytes+opBytes > maxBytes {
+			continue
 		}
 
+		validated, err := ValidateOp(ctx, op)
+		if !validated || err != nil {
+			Log.Debug("op [%s] left out of block [%v]", opHash, err)
+			continue
+		}
+		ctx.ApplyOp(op)
+		ops = append(ops, op)
+		blockBytes += opBytes
+		Log.Trace("mining OpBlock: ", op.Op.Svg)
 	}
+
+	return ops
 }
 
-// Return true if the block hash's prefix is 0.
-// Prefix length: proof of work difficulty of the block
-func ZeroPrefix(block Block) bool {
-	hashString := block.Hash()
-	// Check if prefix has the right number of 0
-	prefix := hashString[:block.GetPowDifficulty()]
-	prefixInt, _ := strconv.ParseInt(prefix, 16, 0)
+// Return an error if ops list an op twice. The last op of an odd Merkle
+// level is paired with itself, so a block listing its last ops twice has
+// the same hash as the block without the copies: it is rejected before it
+// is stored anywhere under that hash.
+// Can return the following errors:
+// - InvalidBlockHashError
+func checkDuplicateOps(ops []Op) error {
+	opHashes := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		opHash := op.HashToString()
+		if opHashes[opHash] {
+			return shared.InvalidBlockHashError("op listed twice in block")
+		}
+		opHashes[opHash] = true
+	}
+	return nil
+}
 
-	return prefixInt == 0
+// Return an error if ops are more than a block may hold
+// Can return the following errors:
+// - InvalidBlockHashError
+func (e *Engine) checkBlockLimits(ops []Op) error {
+	if maxOps := int(e.Settings.MaxOpsPerBlock); maxOps > 0 && len(ops) > maxOps {
+		return shared.InvalidBlockHashError("too many ops in block")
+	}
+
+	if maxBytes := int(e.Settings.MaxBlockBytes); maxBytes > 0 {
+		blockBytes := 0
+		for _, op := range ops {
+			blockBytes += OpSize(op)
+		}
+		if blockBytes > maxBytes {
+			return shared.InvalidBlockHashError("block ops too big")
+		}
+	}
+	return nil
 }
 
 // Mining ink by doing proof of work with the operations in queue
 // Mine NoOpBlock if there is no op in queue
-func Mine() {
+// Returns once the engine is stopped, see Stop
+func (e *Engine) Mine() {
 	for {
-		// Get all queue ops if any, use opLoad to fix content
-		opLoad := opQueue
-
+		// Snapshot the leaf and the queued ops, so the queue can keep
+		// filling up while the nonce is searched for.
+		// The search is cancelled as soon as either changes.
+		e.lock.Lock()
+		for e.miningPaused && !e.stopped {
+			e.miningResumed.Wait()
+		}
+		if e.stopped {
+			e.lock.Unlock()
+			return
+		}
 		// Extending from the longestLeafHash
-		previousHash := longestLeafHash
+		previousHash := e.longestLeafHash
+		ops := e.selectOps(previousHash)
+		difficulty := e.powDifficulty(previousHash, len(ops) > 0)
+		// Later than the median time past, even if our clock is behind
+		timestamp := BlockTimestamp(time.Now())
+		if medianTime := e.medianTimePast(previousHash); timestamp <= medianTime {
+			timestamp = medianTime + 1
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		e.cancelMining = cancel
+		e.lock.Unlock()
+
 		var block Block
-		if len(opLoad) > 0 {
+		if len(ops) > 0 {
 			// Construct an OpBlock
-			var ops []Op
-			for _, opPtr := range opLoad {
-				ops = append(ops, *opPtr)
-				Log.Trace("mining OpBlock: ", opPtr.Op.Svg)
-			}
-
 			block = OpBlock{
+				Version:     e.Settings.BlockVersion,
 				PrevHash:    previousHash,
 				Ops:         ops,
-				PubKeyMiner: PubKeyStr,
+				PubKeyMiner: e.PubKeyStr,
+				Timestamp:   timestamp,
 				Nonce:       0,
 			}
 
 		} else {
 			// Construct a NoOpBlock
 			block = NoOpBlock{
+				Version:     e.Settings.BlockVersion,
 				PrevHash:    previousHash,
-				PubKeyMiner: PubKeyStr,
+				PubKeyMiner: e.PubKeyStr,
+				Timestamp:   timestamp,
 				Nonce:       0,
 			}
 		}
 
-		block = FindNonce(block)
+		start := time.Now()
+		block = e.FindNonce(ctx, block, difficulty)
+		cancel()
+		e.recordSealing(time.Since(start), block != nil, difficulty)
 
 		// If nonce is found
 		if block != nil {
 			// Disseminate the block
-			DisseminateBlock(block)
+			e.DisseminateBlock(block)
 
 		}
 
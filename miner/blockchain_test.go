@@ -0,0 +1,323 @@
+package miner
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+// Engine on the dev PoW whose miner owns the ink of numBlocks no-op blocks,
+// without a network or a mining loop
+func newTestEngineWithInk(t *testing.T, settings MinerNetSettings, numBlocks int) *Engine {
+	settings.PoWAlgorithm = PoWDev
+	e, _ := newTestEngine(t, settings)
+
+	var err error
+	if e.blockStore, err = OpenBlockStore(e.DataDir); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numBlocks; i++ {
+		e.AddBlockToBlockchain(NoOpBlock{
+			Version:     settings.BlockVersion,
+			PrevHash:    e.LongestLeafHash(),
+			PubKeyMiner: e.PubKeyStr,
+			Timestamp:   BlockTimestamp(time.Now()) + int64(i),
+		})
+	}
+	return e
+}
+
+// Ops go in oldest first, and whatever doesn't fit waits for the next block
+func TestSelectOpsLimits(t *testing.T) {
+	settings := testSettings
+	settings.MaxOpsPerBlock = 2
+	e := newTestEngineWithInk(t, settings, 3)
+	defer os.RemoveAll(e.DataDir)
+
+	var queued []Op
+	for i := 0; i < 3; i++ {
+		op := testOp(t, e, 100+50*i, 0)
+		if ok, err := e.queueOp(op); !ok || err != nil {
+			t.Fatalf("op [%d] not queued [%v]", i, err)
+		}
+		queued = append(queued, op)
+	}
+
+	e.lock.RLock()
+	ops := e.selectOps(e.longestLeafHash)
+	e.lock.RUnlock()
+	if len(ops) != 2 || ops[0].HashToString() != queued[0].HashToString() || ops[1].HashToString() != queued[1].HashToString() {
+		t.Fatalf("expected the first two ops queued, got [%d] ops", len(ops))
+	}
+	if err := e.checkBlockLimits(queued); err == nil {
+		t.Errorf("block with [%d] ops accepted", len(queued))
+	}
+
+	// Room for one op only
+	e.Settings.MaxOpsPerBlock = 0
+	e.Settings.MaxBlockBytes = uint32(OpSize(queued[0]) + OpSize(queued[1]) - 1)
+	e.lock.RLock()
+	ops = e.selectOps(e.longestLeafHash)
+	e.lock.RUnlock()
+	if len(ops) != 1 || ops[0].HashToString() != queued[0].HashToString() {
+		t.Errorf("expected the first op queued, got [%d] ops", len(ops))
+	}
+	if err := e.checkBlockLimits(queued[:2]); err == nil {
+		t.Errorf("block over [%d] bytes accepted", e.Settings.MaxBlockBytes)
+	}
+}
+
+// Fees move ink from the op's owner to the block's miner, and are signed
+func TestOpFee(t *testing.T) {
+	settings := testSettings
+	settings.OpOrderPolicy = OpOrderFee
+	e := newTestEngineWithInk(t, settings, 3)
+	defer os.RemoveAll(e.DataDir)
+
+	cheap := testOp(t, e, 100, 0)
+	op := testOp(t, e, 200, 0)
+	op.Fee = 7
+	op = signTestOp(t, e, op)
+
+	tampered := op
+	tampered.Fee = 1
+	ctx, err := e.NewValidationContext(e.LongestLeafHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validated, _ := ValidateOp(ctx, tampered); validated {
+		t.Errorf("op with a changed fee accepted")
+	}
+
+	// The higher fee goes first, even though it arrived last
+	for _, queued := range []Op{cheap, op} {
+		if ok, err := e.queueOp(queued); !ok || err != nil {
+			t.Fatalf("op not queued [%v]", err)
+		}
+	}
+	e.lock.RLock()
+	ops := e.selectOps(e.longestLeafHash)
+	e.lock.RUnlock()
+	if len(ops) != 2 || ops[0].Fee != op.Fee {
+		t.Fatalf("expected the op paying a fee first, got [%d] ops", len(ops))
+	}
+
+	const miner = "0123456789abcdef"
+	ownerInk := e.GetInk(e.PubKeyStr)
+	e.AddBlockToBlockchain(OpBlock{
+		Version:     settings.BlockVersion,
+		PrevHash:    e.LongestLeafHash(),
+		Ops:         ops,
+		PubKeyMiner: miner,
+		Timestamp:   BlockTimestamp(time.Now()) + 10,
+	})
+
+	spent := ShapeInk(cheap.Op) + ShapeInk(op.Op) + op.Fee
+	if ink := e.GetInk(e.PubKeyStr); ink != ownerInk-spent {
+		t.Errorf("owner has [%d] ink, want [%d]", ink, ownerInk-spent)
+	}
+	if ink := e.GetInk(miner); ink != settings.InkPerOpBlock+op.Fee {
+		t.Errorf("miner has [%d] ink, want [%d]", ink, settings.InkPerOpBlock+op.Fee)
+	}
+}
+
+// Only the shape's owner can delete it, with a signature of its own: the
+// add op's signature doesn't cover a delete op
+func TestDeleteOpSignature(t *testing.T) {
+	settings := testSettings
+	e := newTestEngineWithInk(t, settings, 3)
+	defer os.RemoveAll(e.DataDir)
+	other, _ := newTestEngine(t, settings)
+	defer os.RemoveAll(other.DataDir)
+
+	add := testOp(t, e, 100, 0)
+	add.Fee = 7
+	add = signTestOp(t, e, add)
+	e.AddBlockToBlockchain(OpBlock{
+		Version:     settings.BlockVersion,
+		PrevHash:    e.LongestLeafHash(),
+		Ops:         []Op{add},
+		PubKeyMiner: e.PubKeyStr,
+		Timestamp:   BlockTimestamp(time.Now()) + 10,
+	})
+	addHash := add.HashToString()
+
+	ctx, err := e.NewValidationContext(e.LongestLeafHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := Op{Op: add.Op, OpSig: add.OpSig, PubKey: add.PubKey, Fee: add.Fee, AddOpHash: addHash}
+	if validated, _ := ValidateOp(ctx, replayed); validated {
+		t.Errorf("delete op reusing the add op's signature accepted")
+	}
+	foreign := signTestOp(t, other, Op{Op: add.Op, PubKey: other.PubKeyStr, AddOpHash: addHash})
+	if validated, _ := ValidateOp(ctx, foreign); validated {
+		t.Errorf("delete op of another miner accepted")
+	}
+
+	del := signTestOp(t, e, Op{Op: add.Op, PubKey: e.PubKeyStr, ValidNum: 1, AddOpHash: addHash})
+	if validated, err := ValidateOp(ctx, del); !validated {
+		t.Fatalf("owner's delete op rejected [%v]", err)
+	}
+	ctx.ApplyOp(del)
+	again := signTestOp(t, e, Op{Op: add.Op, PubKey: e.PubKeyStr, ValidNum: 1, AddOpHash: addHash})
+	if validated, _ := ValidateOp(ctx, again); validated {
+		t.Errorf("shape deleted twice")
+	}
+}
+
+// A mined op can't be queued again under another hash: neither with its
+// ValidNum changed nor with the other valid signature, s replaced by N-s
+func TestMinedOpReplay(t *testing.T) {
+	settings := testSettings
+	e := newTestEngineWithInk(t, settings, 3)
+	defer os.RemoveAll(e.DataDir)
+
+	op := testOp(t, e, 100, 0)
+	e.AddBlockToBlockchain(OpBlock{
+		Version:     settings.BlockVersion,
+		PrevHash:    e.LongestLeafHash(),
+		Ops:         []Op{op},
+		PubKeyMiner: e.PubKeyStr,
+		Timestamp:   BlockTimestamp(time.Now()) + 10,
+	})
+
+	bumped := op
+	bumped.ValidNum++
+	if queued, _ := e.queueOp(bumped); queued {
+		t.Errorf("mined op queued again with its ValidNum changed")
+	}
+
+	flipped := op
+	flipped.OpSig.S = new(big.Int).Sub(e.PrivKey.Curve.Params().N, op.OpSig.S)
+	if !ecdsa.Verify(&e.PrivKey.PublicKey, flipped.SignedBytes(), flipped.OpSig.R, flipped.OpSig.S) {
+		t.Fatalf("N-s signature does not verify")
+	}
+	if flipped.HashToString() != op.HashToString() {
+		t.Errorf("op hash depends on the signature")
+	}
+	if queued, _ := e.queueOp(flipped); queued {
+		t.Errorf("mined op queued again with s replaced by N-s")
+	}
+
+	if queued := e.GetQueuedOps(); len(queued) != 0 {
+		t.Errorf("[%d] replayed ops queued", len(queued))
+	}
+}
+
+// Mined ink can only be spent once its block is buried RewardMaturity deep
+func TestRewardMaturity(t *testing.T) {
+	settings := testSettings
+	settings.RewardMaturity = 2
+	e := newTestEngineWithInk(t, settings, 1)
+	defer os.RemoveAll(e.DataDir)
+
+	balance := e.GetInkBalance(e.PubKeyStr)
+	if balance.Mature != 0 || balance.Pending != settings.InkPerNoOpBlock {
+		t.Fatalf("after 1 block: [%d] mature, [%d] pending", balance.Mature, balance.Pending)
+	}
+	ctx, err := e.NewValidationContext(e.LongestLeafHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateOp(ctx, testOp(t, e, 100, 0)); err == nil {
+		t.Errorf("op spending immature ink accepted")
+	}
+
+	for i := 0; i < 2; i++ {
+		e.AddBlockToBlockchain(NoOpBlock{
+			Version:     settings.BlockVersion,
+			PrevHash:    e.LongestLeafHash(),
+			PubKeyMiner: e.PubKeyStr,
+			Timestamp:   BlockTimestamp(time.Now()) + 10 + int64(i),
+		})
+	}
+	balance = e.GetInkBalance(e.PubKeyStr)
+	if balance.Mature != settings.InkPerNoOpBlock || balance.Pending != 2*settings.InkPerNoOpBlock {
+		t.Errorf("after 3 blocks: [%d] mature, [%d] pending", balance.Mature, balance.Pending)
+	}
+	if e.GetInk(e.PubKeyStr) != balance.Mature {
+		t.Errorf("GetInk should only count mature ink")
+	}
+}
+
+// A block is validated against the state of its parent, not the longest
+// leaf's: an op already on the longest chain is valid on a side branch
+// forking before it, and a delete op of a shape only on the longest chain
+// is not
+func TestValidateBlockAgainstParent(t *testing.T) {
+	settings := testSettings
+	e := newTestEngineWithInk(t, settings, 3)
+	defer os.RemoveAll(e.DataDir)
+
+	const miner = "0123456789abcdef"
+	forkHash := e.LongestLeafHash()
+	add := testOp(t, e, 100, 0)
+	longest := OpBlock{Version: settings.BlockVersion, PrevHash: forkHash, Ops: []Op{add}, PubKeyMiner: miner, Timestamp: BlockTimestamp(time.Now()) + 10}
+	e.AddBlockToBlockchain(longest)
+	if e.LongestLeafHash() != longest.Hash() {
+		t.Fatalf("block with the op is not the longest leaf")
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	side := OpBlock{Version: settings.BlockVersion, PrevHash: forkHash, Ops: []Op{add}, PubKeyMiner: miner, Timestamp: BlockTimestamp(time.Now()) + 11}
+	if validated, err := e.validateBlock(side); !validated || err != nil {
+		t.Errorf("op of the longest chain rejected on a side branch [%v]", err)
+	}
+
+	del := signTestOp(t, e, Op{Op: add.Op, PubKey: e.PubKeyStr, AddOpHash: add.HashToString()})
+	onLeaf := OpBlock{Version: settings.BlockVersion, PrevHash: longest.Hash(), Ops: []Op{del}, PubKeyMiner: miner, Timestamp: BlockTimestamp(time.Now()) + 11}
+	if validated, err := e.validateBlock(onLeaf); !validated || err != nil {
+		t.Fatalf("delete op rejected on the longest leaf [%v]", err)
+	}
+	onSide := OpBlock{Version: settings.BlockVersion, PrevHash: forkHash, Ops: []Op{del}, PubKeyMiner: miner, Timestamp: BlockTimestamp(time.Now()) + 11}
+	if validated, _ := e.validateBlock(onSide); validated {
+		t.Errorf("delete op of a shape not on the branch accepted")
+	}
+}
+
+// Ops of one block are validated one after another: two ops that each fit
+// are rejected together if they overspend ink or overlap
+func TestValidateBlockOpsTogether(t *testing.T) {
+	settings := testSettings
+	e := newTestEngineWithInk(t, settings, 1)
+	defer os.RemoveAll(e.DataDir)
+	other, _ := newTestEngine(t, settings)
+	defer os.RemoveAll(other.DataDir)
+
+	const miner = "0123456789abcdef"
+	e.AddBlockToBlockchain(NoOpBlock{Version: settings.BlockVersion, PrevHash: e.LongestLeafHash(), PubKeyMiner: other.PubKeyStr, Timestamp: BlockTimestamp(time.Now()) + 10})
+	parentHash := e.LongestLeafHash()
+	ink := e.GetInk(e.PubKeyStr)
+
+	// Each circle costs more than half of the miner's ink
+	circle := func(owner *Engine, x int, r int, validNum uint8) Op {
+		op := testOp(t, owner, x, validNum)
+		op.Op.Svg = fmt.Sprintf("cx %d cy %d r %d", x, x, r)
+		return signTestOp(t, owner, op)
+	}
+	first, second := circle(e, 100, 10, 0), circle(e, 300, 10, 0)
+	if cost := ShapeInk(first.Op); 2*cost <= ink || cost > ink {
+		t.Fatalf("circle costs [%d] of [%d] ink", cost, ink)
+	}
+	overlapping := circle(other, 100, 10, 0)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, ops := range [][]Op{{first}, {second}, {overlapping}} {
+		block := OpBlock{Version: settings.BlockVersion, PrevHash: parentHash, Ops: ops, PubKeyMiner: miner, Timestamp: BlockTimestamp(time.Now()) + 11}
+		if validated, err := e.validateBlock(block); !validated || err != nil {
+			t.Fatalf("op alone rejected [%v]", err)
+		}
+	}
+	for _, ops := range [][]Op{{first, second}, {first, overlapping}} {
+		block := OpBlock{Version: settings.BlockVersion, PrevHash: parentHash, Ops: ops, PubKeyMiner: miner, Timestamp: BlockTimestamp(time.Now()) + 11}
+		if validated, _ := e.validateBlock(block); validated {
+			t.Errorf("ops overspending or overlapping together accepted")
+		}
+	}
+}
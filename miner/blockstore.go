@@ -0,0 +1,110 @@
+package miner
+
+import (
+	"../shared"
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Name of the block log file inside the miner's data directory
+const blockStoreFile = "blocks.dat"
+
+// Durable, append-only store of every block added to the tree table.
+// Each record is a 4-byte big endian length followed by a gob encoded
+// GeneralBlock. Blocks are appended in the order they were added, so
+// a block's parent is always stored before the block itself.
+type BlockStore struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// Open (or create) the block store under dataDir
+func OpenBlockStore(dataDir string) (store *BlockStore, err error) {
+	err = os.MkdirAll(dataDir, 0700)
+	if err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(filepath.Join(dataDir, blockStoreFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	return &BlockStore{file: file}, nil
+}
+
+// Read all blocks in the store, in the order they were appended.
+// A partially written record at the end of the file (e.g. the miner
+// crashed mid-append) is discarded and truncated away.
+func (bs *BlockStore) Load() (blocks []Block, err error) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	_, err = bs.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(bs.file)
+	var validLen int64
+	lenBytes := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(reader, lenBytes); err != nil {
+			break
+		}
+		record := make([]byte, binary.BigEndian.Uint32(lenBytes))
+		if _, err = io.ReadFull(reader, record); err != nil {
+			// the length prefix was written, the record was not
+			err = io.ErrUnexpectedEOF
+			break
+		}
+
+		var genBlock GeneralBlock
+		shared.Deserialize(record, &genBlock)
+		blocks = append(blocks, genBlock.ToBlock())
+		validLen += int64(len(lenBytes) + len(record))
+	}
+
+	if err != io.EOF {
+		Log.Error("block store has a truncated record, discarding after offset [%d]", validLen)
+		if err = bs.file.Truncate(validLen); err != nil {
+			return
+		}
+	}
+
+	_, err = bs.file.Seek(validLen, io.SeekStart)
+	return
+}
+
+// Append block to the end of the store and flush it to disk
+func (bs *BlockStore) Append(block Block) (err error) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	record := shared.Serialize(ToGeneralBlock(block))
+	lenBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBytes, uint32(len(record)))
+
+	offset, err := bs.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+
+	args := [2][]byte{lenBytes, record}
+	if _, err = bs.file.Write(shared.ConcateByteArr(args[:])); err != nil {
+		// Drop the partial record so later appends stay readable
+		bs.file.Truncate(offset)
+		bs.file.Seek(offset, io.SeekStart)
+		return
+	}
+
+	return bs.file.Sync()
+}
+
+func (bs *BlockStore) Close() error {
+	return bs.file.Close()
+}
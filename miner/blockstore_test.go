@@ -0,0 +1,113 @@
+package miner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testStoreBlocks(t *testing.T, e *Engine, n int) (blocks []Block) {
+	prevHash := e.Settings.GenesisBlockHash
+	for i := 0; i < n; i++ {
+		var block Block = NoOpBlock{Version: e.Settings.BlockVersion, PrevHash: prevHash, PubKeyMiner: e.PubKeyStr, Timestamp: int64(i + 1)}
+		if i%2 == 1 {
+			block = OpBlock{Version: e.Settings.BlockVersion, PrevHash: prevHash, Ops: []Op{testOp(t, e, 100*i, 2)}, PubKeyMiner: e.PubKeyStr, Timestamp: int64(i + 1)}
+		}
+		blocks = append(blocks, block)
+		prevHash = block.Hash()
+	}
+	return blocks
+}
+
+func loadTestStore(t *testing.T, dataDir string) (store *BlockStore, blocks []Block) {
+	store, err := OpenBlockStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return store, blocks
+}
+
+func checkStoredBlocks(t *testing.T, stored []Block, want []Block) {
+	if len(stored) != len(want) {
+		t.Fatalf("loaded [%d] blocks, want [%d]", len(stored), len(want))
+	}
+	for i := range want {
+		if stored[i].Hash() != want[i].Hash() {
+			t.Errorf("block [%d] is [%s], want [%s]", i, stored[i].Hash(), want[i].Hash())
+		}
+	}
+}
+
+// Blocks appended by a miner are reloaded in order after a restart
+func TestBlockStoreReload(t *testing.T) {
+	e, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(e.DataDir)
+	blocks := testStoreBlocks(t, e, 4)
+
+	store, stored := loadTestStore(t, e.DataDir)
+	if len(stored) != 0 {
+		t.Fatalf("new store has [%d] blocks", len(stored))
+	}
+	for _, block := range blocks {
+		if err := store.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	store, stored = loadTestStore(t, e.DataDir)
+	defer store.Close()
+	checkStoredBlocks(t, stored, blocks)
+}
+
+// A record cut short by a crash is dropped, and the blocks appended after
+// the restart are stored after the last whole record
+func TestBlockStoreTruncatedRecord(t *testing.T) {
+	e, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(e.DataDir)
+	blocks := testStoreBlocks(t, e, 3)
+
+	store, _ := loadTestStore(t, e.DataDir)
+	for _, block := range blocks[:2] {
+		if err := store.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	// Half of the last block's record made it to disk
+	path := filepath.Join(e.DataDir, blockStoreFile)
+	whole, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, _ = loadTestStore(t, e.DataDir)
+	store.Append(blocks[2])
+	store.Close()
+	withLast, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := len(whole) + (len(withLast)-len(whole))/2
+	if err := os.Truncate(path, int64(cut)); err != nil {
+		t.Fatal(err)
+	}
+
+	store, stored := loadTestStore(t, e.DataDir)
+	checkStoredBlocks(t, stored, blocks[:2])
+	if info, _ := os.Stat(path); info.Size() != int64(len(whole)) {
+		t.Errorf("store is [%d] bytes after recovery, want [%d]", info.Size(), len(whole))
+	}
+
+	if err := store.Append(blocks[2]); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, stored = loadTestStore(t, e.DataDir)
+	defer store.Close()
+	checkStoredBlocks(t, stored, blocks)
+}
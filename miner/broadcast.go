@@ -0,0 +1,171 @@
+package miner
+
+import (
+	"../shared"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Calls to a neighbour are queued and made by one worker per neighbour, so a
+// slow neighbour only delays its own traffic. A neighbour that does not keep
+// up is dropped.
+const (
+	// Calls waiting in a neighbour's queue
+	peerQueueSize = 256
+
+	// How long a sender waits for room in a full queue before the
+	// neighbour is dropped
+	peerEnqueueTimeout = time.Second
+
+	// How long a call to a neighbour may take before the neighbour is dropped
+	peerCallTimeout = 10 * time.Second
+)
+
+// A call queued for a neighbour. Queued calls are notifications: their
+// reply is ignored.
+type outboundCall struct {
+	method string
+	args   interface{}
+}
+
+// Calls waiting to be sent on one connection to a neighbour
+type peerQueue struct {
+	peer  Peer
+	calls chan outboundCall
+
+	// Closed when the queue is removed, stops its worker
+	done chan struct{}
+}
+
+// Outbound queues of the neighbours
+type outbound struct {
+	lock sync.Mutex
+
+	// Key: neighbour's public key
+	queues map[string]*peerQueue
+}
+
+func newOutbound() *outbound {
+	return &outbound{queues: make(map[string]*peerQueue)}
+}
+
+// Return the neighbour's queue for peer, replacing the queue of a previous
+// connection. created is true if the queue is new and needs a worker.
+// Return nil unless peer is the neighbour's connection in transport:
+// nothing would remove the queue of a disconnected neighbour.
+func (o *outbound) queue(pubKey string, peer Peer, transport Transport) (q *peerQueue, created bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	// Checked under o.lock, so a neighbour disconnected from now on has its
+	// queue removed after it is created
+	if current, connected := transport.Neighbours()[pubKey]; !connected || current != peer {
+		return nil, false
+	}
+
+	if q, exists := o.queues[pubKey]; exists {
+		if q.peer == peer {
+			return q, false
+		}
+		close(q.done)
+	}
+	q = &peerQueue{peer: peer, calls: make(chan outboundCall, peerQueueSize), done: make(chan struct{})}
+	o.queues[pubKey] = q
+	return q, true
+}
+
+// Stop the neighbour's queue. The calls still queued are dropped.
+func (o *outbound) remove(pubKey string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if q, exists := o.queues[pubKey]; exists {
+		close(q.done)
+		delete(o.queues, pubKey)
+	}
+}
+
+// Queue a call to the neighbour with the given public key, without waiting
+// for it to be made. If the queue stays full for peerEnqueueTimeout, the
+// neighbour is dropped. The call is dropped if peer is no longer the
+// neighbour's connection.
+func (e *Engine) sendToPeer(pubKey string, peer Peer, method string, args interface{}) {
+	q, created := e.outbound.queue(pubKey, peer, e.Transport)
+	if q == nil {
+		Log.Debug("Neighbour [%s] disconnected, dropping call [%s]", pubKey, method)
+		return
+	}
+	if created {
+		go e.drainPeerQueue(pubKey, q)
+	}
+
+	call := outboundCall{method: method, args: args}
+	select {
+	case q.calls <- call:
+		return
+	default:
+	}
+
+	// Queue full: hold the sender back, up to a limit
+	timer := time.NewTimer(peerEnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case q.calls <- call:
+	case <-q.done:
+	case <-timer.C:
+		Log.Error("Neighbour [%s] is not keeping up, dropping it", pubKey)
+		e.dropPeer(pubKey, peer)
+	}
+}
+
+// Make the queued calls to a neighbour one after another, until the queue
+// is removed. A neighbour that times out or whose connection fails is
+// dropped, an error returned by the call itself is only logged.
+func (e *Engine) drainPeerQueue(pubKey string, q *peerQueue) {
+	for {
+		select {
+		case <-q.done:
+			return
+		case call := <-q.calls:
+			var reply int
+			err := callPeer(q.peer, call.method, call.args, &reply)
+			if _, failed := err.(rpc.ServerError); failed {
+				Log.Error("rpc call err [%s]", err.Error())
+			} else if err != nil {
+				Log.Error("rpc call err [%s], dropping neighbour [%s]", err.Error(), pubKey)
+				e.dropPeer(pubKey, q.peer)
+				return
+			}
+		}
+	}
+}
+
+// Disconnect the neighbour, unless it has reconnected since peer was used
+func (e *Engine) dropPeer(pubKey string, peer Peer) {
+	if current, connected := e.Transport.Neighbours()[pubKey]; connected && current == peer {
+		e.DisconnectPeer(pubKey)
+	}
+}
+
+// Call a neighbour, giving up after peerCallTimeout
+// Can return the following errors:
+// - PeerTimeoutError
+// - errors of the call
+func callPeer(peer Peer, method string, args interface{}, reply interface{}) error {
+	result := make(chan error, 1)
+	go func() {
+		// Once the neighbour is dropped its connection is closed,
+		// which ends a call still waiting
+		result <- peer.Call(method, args, reply)
+	}()
+
+	timer := time.NewTimer(peerCallTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return shared.PeerTimeoutError(method)
+	}
+}
@@ -0,0 +1,88 @@
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Neighbour whose calls hang until it is closed, or fail right away
+type stubPeer struct {
+	fail   bool
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newStubPeer(fail bool) *stubPeer {
+	return &stubPeer{fail: fail, closed: make(chan struct{})}
+}
+
+func (p *stubPeer) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	if p.fail {
+		return errors.New("connection reset")
+	}
+	<-p.closed
+	return rpc.ErrShutdown
+}
+
+func (p *stubPeer) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+// A neighbour that hangs or fails is dropped, without blocking the others
+func TestSlowPeerDropped(t *testing.T) {
+	e, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(e.DataDir)
+
+	hung, failing := newStubPeer(false), newStubPeer(true)
+	e.Transport.AddNeighbour("hung", hung)
+	e.Transport.AddNeighbour("failing", failing)
+
+	// The worker holds one call, the queue the next peerQueueSize
+	start := time.Now()
+	for i := 0; i < peerQueueSize+2; i++ {
+		e.announceInv([]string{fmt.Sprint(i)}, nil)
+	}
+	if elapsed := time.Since(start); elapsed > peerEnqueueTimeout+time.Second {
+		t.Errorf("senders held back for [%s]", elapsed)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); e.Transport.NumNeighbours() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if neighbours := e.GetNeighbours(); len(neighbours) != 0 {
+		t.Errorf("slow neighbours not dropped %v", neighbours)
+	}
+	select {
+	case <-hung.closed:
+	default:
+		t.Errorf("hung neighbour's connection not closed")
+	}
+}
+
+func TestNoQueueForStalePeer(t *testing.T) {
+	e, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(e.DataDir)
+
+	stale, current := newStubPeer(true), newStubPeer(true)
+	e.sendToPeer("gone", stale, "MinerMinerRPC.AnnounceInv", InvArgs{})
+
+	// A call through a replaced connection doesn't replace the current queue
+	e.Transport.AddNeighbour("reconnected", current)
+	e.sendToPeer("reconnected", current, "MinerMinerRPC.AnnounceInv", InvArgs{})
+	e.sendToPeer("reconnected", stale, "MinerMinerRPC.AnnounceInv", InvArgs{})
+
+	e.outbound.lock.Lock()
+	defer e.outbound.lock.Unlock()
+	if _, exists := e.outbound.queues["gone"]; exists {
+		t.Errorf("queue created for a disconnected neighbour")
+	}
+	if q, exists := e.outbound.queues["reconnected"]; !exists || q.peer != current {
+		t.Errorf("queue of the current connection replaced")
+	}
+}
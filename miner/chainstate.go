@@ -0,0 +1,341 @@
+package miner
+
+// Key: op hash
+// Val: shape waiting to be added to/deleted from the canvas
+type QueueShapes map[string]*QueueShape
+
+// Key: op hash
+// Val: op from Genesis up to a block
+type OpLog struct {
+	layers *stateLayers
+}
+
+// Key: op hash
+// Val: shape on the canvas as of a block
+type CanvasShapes struct {
+	layers *stateLayers
+}
+
+// Key: block hash
+// Val: ink its miner earned, not spendable yet
+type ImmatureRewards map[string]*ImmatureReward
+
+// Ink a miner earned for a block, spendable once Blocks more blocks are on top
+type ImmatureReward struct {
+	Miner  string
+	Ink    uint32
+	Blocks uint32
+}
+
+// Canvas and ink state as of a block.
+// Every BlockChainNode owns its own ChainState, so sibling forks can hold
+// different ink balances and canvases. A child's state is a copy of its
+// parent's state with the child block applied; the parent is never mutated.
+// The canvas and op log grow with the chain, so a copy only holds what its
+// block changes, on top of its parent's, see stateLayers.
+type ChainState struct {
+	InkTable InkTable     // Stores the inks of each miner up to this block.
+	Canvas   CanvasShapes // All shapes on Canvas from Genesis to this block,
+	// not including side branches
+	// Key: Op hash
+	QueueShapes QueueShapes // All shapes in queue waiting to be validated by other blocks
+	// key: shape hash
+	// Operation log, storing all operations from Genesis to this block
+	// Usage: check no overlapped operations
+	OpLog OpLog
+	// Block rewards and fees not counted in InkTable yet, see RewardMaturity
+	ImmatureRewards ImmatureRewards
+}
+
+// Return an empty state, the state of the Genesis block
+func NewChainState() ChainState {
+	return ChainState{
+		InkTable:    make(InkTable),
+		Canvas:      CanvasShapes{newStateLayers()},
+		QueueShapes: make(QueueShapes),
+		OpLog:       OpLog{newStateLayers()},
+
+		ImmatureRewards: make(ImmatureRewards),
+	}
+}
+
+// Return a copy of the state that can be modified without affecting this one.
+// This state must not be modified afterwards: the canvas and op log of the
+// copy are layered on top of its own.
+// MinerCanvas and Op entries are never modified once added, so they are shared;
+// QueueShape and ImmatureReward entries are counted down in place, so they are copied.
+// The ink table, queued shapes and immature rewards are bounded by the
+// number of miners and the ops and blocks still counting down, so they are
+// copied.
+func (state ChainState) Copy() ChainState {
+	newState := ChainState{
+		InkTable:    make(InkTable, len(state.InkTable)),
+		Canvas:      CanvasShapes{state.Canvas.layers.child()},
+		QueueShapes: make(QueueShapes, len(state.QueueShapes)),
+		OpLog:       OpLog{state.OpLog.layers.child()},
+
+		ImmatureRewards: make(ImmatureRewards, len(state.ImmatureRewards)),
+	}
+
+	for key, ink := range state.InkTable {
+		newState.InkTable[key] = ink
+	}
+	for key, queueShape := range state.QueueShapes {
+		qs := *queueShape
+		newState.QueueShapes[key] = &qs
+	}
+	for key, reward := range state.ImmatureRewards {
+		r := *reward
+		newState.ImmatureRewards[key] = &r
+	}
+
+	return newState
+}
+
+// Merge the layers of the canvas and op log once they are maxStateLayers deep
+func (state *ChainState) compact() {
+	state.Canvas.layers = state.Canvas.layers.compact()
+	state.OpLog.layers = state.OpLog.layers.compact()
+}
+
+// Add/Delete the queued shape to/from Canvas
+// Precondition: the op that queued it, keyed by opHash, is in OpLog
+func (state ChainState) matureShape(opHash string, queueShape *QueueShape) {
+	if queueShape.Add {
+		minerCanvas := MinerCanvas{
+			Shape:     queueShape.Shape,
+			BlockHash: queueShape.BlockHash,
+		}
+		state.Canvas.add(opHash, &minerCanvas)
+	} else {
+		// Retrieve key for op's add hash from opLog
+		deleteOp, _ := state.OpLog.Get(opHash)
+		state.Canvas.remove(deleteOp.AddOpHash)
+	}
+}
+
+// Return the ink of pubKey that is not spendable yet
+func (state ChainState) ImmatureInk(pubKey string) (ink uint32) {
+	for _, reward := range state.ImmatureRewards {
+		if reward.Miner == pubKey {
+			ink += reward.Ink
+		}
+	}
+	return ink
+}
+
+// Apply block on top of this state, rewarding its miner according to settings
+// Precondition: state is a copy owned by the block's new node, and block is valid
+// ValidNum of the shapes queued by ancestors is decremented by one,
+// and so is the maturity countdown of their rewards
+func (state ChainState) applyBlock(block Block, settings MinerNetSettings) {
+	for key, reward := range state.ImmatureRewards {
+		reward.Blocks--
+		if reward.Blocks == 0 {
+			state.InkTable[reward.Miner] += reward.Ink
+			delete(state.ImmatureRewards, key)
+		}
+	}
+
+	queueShapes := state.QueueShapes
+
+	for key, queueShape := range queueShapes {
+		queueShape.ValidNum--
+		if queueShape.ValidNum > 0 {
+			// Do nothing
+		} else {
+			state.matureShape(key, queueShape)
+
+			// Delete from qeueShape, it's reached valid num
+			delete(queueShapes, key)
+		}
+	}
+
+	opLog := state.OpLog
+	inkTable := state.InkTable
+	minerPubKey := block.GetMinerPubKey()
+	if _, ok := inkTable[minerPubKey]; !ok {
+		// Add first ink table entry
+		inkTable[minerPubKey] = 0
+	}
+	minerPubKeySuffix := minerPubKey[len(minerPubKey)-10:]
+	// Reward and fees for mining the block
+	var reward uint32
+	switch block.(type) {
+	case OpBlock:
+		// Reward miner of mining a OpBlock
+		reward += settings.InkPerOpBlock
+
+		// Loop through ops to perform chain logistics
+		// ink transactions, opLog update, queueShapes updates
+		for _, op := range block.GetOps() {
+			op := op
+			Log.Debug("Op[%s] in Block[%s] queued for validation", op.HashToString(), block.Hash())
+
+			// add current ops to queue shapes
+			qs := QueueShape{
+				Shape:     op.Op,
+				ValidNum:  op.ValidNum,
+				Add:       op.Add,
+				BlockHash: block.Hash(),
+			}
+
+			// Add op to log
+			opLog.add(op.HashToString(), &op)
+
+			if qs.ValidNum == 0 {
+				// Needs no block on top, counting it down would wrap around
+				state.matureShape(op.HashToString(), &qs)
+			} else {
+				queueShapes[op.HashToString()] = &qs
+			}
+
+			// reflect Ops cost
+			cost := ShapeInk(op.Op)
+			if op.Add {
+				inkTable[op.PubKey] -= cost
+			} else {
+				inkTable[op.PubKey] += cost
+			}
+
+			// Pay the fee to the miner
+			inkTable[op.PubKey] -= op.Fee
+			reward += op.Fee
+			Log.Debug("Add OpBlock. Ink: [%d], Miner Suffix:[%s]", inkTable[minerPubKey], minerPubKeySuffix)
+		}
+	case NoOpBlock:
+		// Reward miner of mining a NoOpBlock
+		reward += settings.InkPerNoOpBlock
+		Log.Debug("Add NoOpBlock. Ink: [%d], Miner Suffix:[%s]", inkTable[minerPubKey], minerPubKeySuffix)
+	default:
+		// Invariant check
+		Log.Error("Panic: this is not a valid block")
+	}
+
+	// The block may still be orphaned, its reward matures once buried
+	if settings.RewardMaturity == 0 {
+		inkTable[minerPubKey] += reward
+	} else {
+		state.ImmatureRewards[block.Hash()] = &ImmatureReward{
+			Miner:  minerPubKey,
+			Ink:    reward,
+			Blocks: settings.RewardMaturity,
+		}
+	}
+}
+
+// Return the op with the given hash
+func (log OpLog) Get(opHash string) (op *Op, exists bool) {
+	val, exists := log.layers.get(opHash)
+	if !exists {
+		return nil, false
+	}
+	return val.(*Op), true
+}
+
+func (log OpLog) add(opHash string, op *Op) {
+	log.layers.set(opHash, op)
+}
+
+// Return the shape the op with the given hash added to the canvas
+func (canvas CanvasShapes) Get(opHash string) (minerCanvas *MinerCanvas, exists bool) {
+	val, exists := canvas.layers.get(opHash)
+	if !exists {
+		return nil, false
+	}
+	return val.(*MinerCanvas), true
+}
+
+// Call fn with every shape on the canvas
+func (canvas CanvasShapes) Each(fn func(opHash string, minerCanvas *MinerCanvas)) {
+	for opHash, val := range canvas.layers.flatten() {
+		fn(opHash, val.(*MinerCanvas))
+	}
+}
+
+func (canvas CanvasShapes) add(opHash string, minerCanvas *MinerCanvas) {
+	canvas.layers.set(opHash, minerCanvas)
+}
+
+func (canvas CanvasShapes) remove(opHash string) {
+	canvas.layers.remove(opHash)
+}
+
+// ---------------------------------------------------------------------
+// Layered maps
+// ---------------------------------------------------------------------
+
+// Most layers stacked before they are merged, so a lookup visits at
+// most that many maps
+const maxStateLayers = 32
+
+// Map of the entries a block set or removed, on top of the map of its
+// parent, which is never modified again. Sibling forks share the layers
+// of their common ancestors.
+type stateLayers struct {
+	// Entries set in this layer, nil if removed
+	entries map[string]interface{}
+	parent  *stateLayers
+	depth   int
+}
+
+func newStateLayers() *stateLayers {
+	return &stateLayers{entries: make(map[string]interface{})}
+}
+
+// Return an empty layer on top of this one, which must not be modified
+// afterwards
+func (l *stateLayers) child() *stateLayers {
+	return &stateLayers{entries: make(map[string]interface{}), parent: l, depth: l.depth + 1}
+}
+
+// Return the layers merged into one if they are maxStateLayers deep,
+// the same layers otherwise
+func (l *stateLayers) compact() *stateLayers {
+	if l.depth < maxStateLayers {
+		return l
+	}
+	return &stateLayers{entries: l.flatten()}
+}
+
+func (l *stateLayers) get(key string) (val interface{}, exists bool) {
+	for layer := l; layer != nil; layer = layer.parent {
+		if val, set := layer.entries[key]; set {
+			return val, val != nil
+		}
+	}
+	return nil, false
+}
+
+func (l *stateLayers) set(key string, val interface{}) {
+	l.entries[key] = val
+}
+
+func (l *stateLayers) remove(key string) {
+	if l.parent == nil {
+		delete(l.entries, key)
+	} else {
+		l.entries[key] = nil
+	}
+}
+
+// Return the entries of every layer, an upper layer's entries replacing
+// the ones below
+func (l *stateLayers) flatten() map[string]interface{} {
+	var layers []*stateLayers
+	for layer := l; layer != nil; layer = layer.parent {
+		layers = append(layers, layer)
+	}
+
+	entries := make(map[string]interface{})
+	for i := len(layers) - 1; i >= 0; i-- {
+		for key, val := range layers[i].entries {
+			if val == nil {
+				delete(entries, key)
+			} else {
+				entries[key] = val
+			}
+		}
+	}
+	return entries
+}
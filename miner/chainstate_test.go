@@ -0,0 +1,56 @@
+package miner
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// Sibling forks keep their own ink and canvas, and their parent's state is
+// left as it was, however deep the layers of the canvas go
+func TestSiblingForkState(t *testing.T) {
+	settings := testSettings
+	e := newTestEngineWithInk(t, settings, 3)
+	defer os.RemoveAll(e.DataDir)
+
+	const miner = "0123456789abcdef"
+	forkHash := e.LongestLeafHash()
+	forkInk := e.GetInk(e.PubKeyStr)
+	op := testOp(t, e, 100, 0)
+	withShape := OpBlock{Version: settings.BlockVersion, PrevHash: forkHash, Ops: []Op{op}, PubKeyMiner: miner, Timestamp: BlockTimestamp(time.Now()) + 10}
+	without := NoOpBlock{Version: settings.BlockVersion, PrevHash: forkHash, PubKeyMiner: miner, Timestamp: BlockTimestamp(time.Now()) + 11}
+	e.AddBlockToBlockchain(withShape)
+	e.AddBlockToBlockchain(without)
+
+	// Deep enough for the layers to be merged
+	leafHash := withShape.Hash()
+	for i := 0; i < 2*maxStateLayers; i++ {
+		block := NoOpBlock{Version: settings.BlockVersion, PrevHash: leafHash, PubKeyMiner: miner, Timestamp: BlockTimestamp(time.Now()) + 12 + int64(i)}
+		e.AddBlockToBlockchain(block)
+		leafHash = block.Hash()
+	}
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	opHash := op.HashToString()
+	for _, check := range []struct {
+		hash     string
+		ink      uint32
+		hasShape bool
+	}{
+		{forkHash, forkInk, false},
+		{withShape.Hash(), forkInk - ShapeInk(op.Op), true},
+		{leafHash, forkInk - ShapeInk(op.Op), true},
+		{without.Hash(), forkInk, false},
+	} {
+		node := e.treeTable[check.hash]
+		if ink := node.InkTable[e.PubKeyStr]; ink != check.ink {
+			t.Errorf("block [%s]: [%d] ink, want [%d]", check.hash, ink, check.ink)
+		}
+		_, onCanvas := node.Canvas.Get(opHash)
+		_, inLog := node.OpLog.Get(opHash)
+		if onCanvas != check.hasShape || inLog != check.hasShape {
+			t.Errorf("block [%s]: shape on canvas [%t], in op log [%t], want [%t]", check.hash, onCanvas, inLog, check.hasShape)
+		}
+	}
+}
@@ -2,10 +2,9 @@ package miner
 
 import (
 	"../shared"
-	"crypto/ecdsa"
+	"math"
 	"net"
 	"net/rpc"
-	"sync"
 	"time"
 )
 
@@ -28,13 +27,75 @@ type MinerNetSettings struct {
 	HeartBeat uint32
 
 	// Proof of work difficulty: number of zeroes in prefix (>=0)
+	// Hex digits, or bits if PoWDifficultyInBits is set
 	PoWDifficultyOpBlock   uint8
 	PoWDifficultyNoOpBlock uint8
+	PoWDifficultyInBits    bool
+
+	// Proof of work algorithm: hash-prefix (default), memory-hard or dev
+	PoWAlgorithm string
+
+	// Most ops in an OpBlock, and most bytes of its gob encoded ops
+	// (0: no limit)
+	MaxOpsPerBlock uint32
+	MaxBlockBytes  uint32
+
+	// Order queued ops are picked for a block in, see OpOrderArrival
+	OpOrderPolicy uint8
+
+	// Number of blocks on top of a block before its reward and fees
+	// can be spent (0: right away)
+	RewardMaturity uint32
+
+	// Tie-break between tips with the same cumulative work
+	ForkChoicePolicy ForkChoicePolicy
+
+	// Number of blocks between difficulty retargets, 0 keeps the
+	// configured difficulties for good
+	RetargetInterval uint32
+
+	// Milliseconds between blocks that retargeting aims for
+	TargetBlockInterval uint32
+
+	// Header format and hash function of the network's blocks
+	// Networks configured without it use BlockVersion1
+	BlockVersion shared.BlockVersion
 
 	// Canvas settings
 	CanvasSettings shared.CanvasSettings
 }
 
+// Values of MinerNetSettings.OpOrderPolicy
+const (
+	// Oldest op first
+	OpOrderArrival uint8 = iota
+	// Highest fee first, then oldest
+	OpOrderFee
+)
+
+// Return the configured difficulty of op or no-op blocks in leading zero bits
+func (settings MinerNetSettings) DifficultyBits(opBlock bool) int {
+	difficulty := int(settings.PoWDifficultyNoOpBlock)
+	if opBlock {
+		difficulty = int(settings.PoWDifficultyOpBlock)
+	}
+	if settings.PoWDifficultyInBits {
+		return difficulty
+	}
+	// Each hex digit is 4 bits
+	return difficulty * 4
+}
+
+// Return the most leading zero bits a block hash can be required to have:
+// the hash width of the block version, at most what a uint8 difficulty holds
+func (settings MinerNetSettings) MaxDifficultyBits() int {
+	maxDifficulty := settings.BlockVersion.HashBits()
+	if maxDifficulty > math.MaxUint8 {
+		maxDifficulty = math.MaxUint8
+	}
+	return maxDifficulty
+}
+
 // Type for storing all canvas info
 type Canvas struct {
 	Shapes     map[string]Shape // can also be []Shape
@@ -44,49 +105,56 @@ type Canvas struct {
 var (
 	Log = shared.NewLogger(true, true, true)
 
-	ServerIPPort string
-	Server       *rpc.Client
-	MinerIPPort  string // IP:Port for miner-miner
-
-	PrivKey   *ecdsa.PrivateKey
-	PubKeyStr string
-
-	NetSettings MinerNetSettings
-
-	ActiveNeighbours map[string]*rpc.Client
-	NeighbourLock    *sync.Mutex
-	NumNeighbours    int
-	CheckInterval    time.Duration
-
-	// Indicate whether the block chain is successfully initialized
-	initialized bool
+	ServerIPPort  string
+	Server        *rpc.Client
+	CheckInterval time.Duration
 )
 
+// Listen on the outward facing interface and serve v over rpc
 // Asynchronous, caller needs to call Wait()
 func InitRPCServer(v interface{}) (listener net.Listener, err error) {
 	Log.Trace(v)
 
+	listener, err = ListenOutbound()
+	if err != nil {
+		return
+	}
+
+	err = ServeRPC(listener, v)
+	return
+}
+
+// Listen on a free port of the outward facing interface
+func ListenOutbound() (listener net.Listener, err error) {
 	// Get local ip
 	serverAddr, err := getOutBoundIP()
 	if err != nil {
 		return
 	}
 
-	rpc.Register(v)
-
 	// set up RPC listener
 	listener, err = net.Listen("tcp", serverAddr+":0")
 	if err != nil {
 		return
 	}
+	Log.Debug("local address %s", listener.Addr().String())
+	return
+}
 
-	localIPPort = listener.Addr().String()
-	Log.Debug("local address %s", localIPPort)
+// Serve v over rpc on an existing listener
+// Each call gets its own rpc server, so several engines' services can
+// live in the same process
+func ServeRPC(listener net.Listener, v interface{}) (err error) {
+	server := rpc.NewServer()
+	err = server.Register(v)
+	if err != nil {
+		return
+	}
 
 	// Start RPC Server
 	go func() {
-		Log.Debug("RPC Server for artnode ready")
-		rpc.Accept(listener)
+		Log.Debug("RPC Server ready on [%s]", listener.Addr().String())
+		server.Accept(listener)
 	}()
 
 	return
@@ -106,10 +174,6 @@ func getOutBoundIP() (string, error) {
 }
 
 func init() {
-	NetSettings.CanvasSettings = shared.CanvasSettings{}
-	NumNeighbours = 0
-	NeighbourLock = new(sync.Mutex)
-	ActiveNeighbours = make(map[string]*rpc.Client)
 	CheckInterval = 2000 * time.Millisecond
 	artnodeRegHash = shared.HashByteArr([]byte(shared.ArtnodeRegMsg))
 }
@@ -0,0 +1,175 @@
+package miner
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// Number of ancestors whose median timestamp a block must be later than
+	medianTimeBlocks = 11
+
+	// How far in the future a block's timestamp may be
+	maxFutureDrift = 2 * time.Minute
+
+	// Work factor of one difficulty step: one more leading zero bit
+	difficultyStepFactor = 2
+
+	// Most difficulty steps a single retarget moves
+	maxRetargetSteps = 2
+)
+
+// Return the current time as a block timestamp
+func BlockTimestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Return the difficulty in leading zero bits required for a block
+// extending parentHash: the configured difficulty for its type,
+// shifted by the retargets on the chain up to the parent, as the
+// proof of work algorithm requires it
+// Precondition: e.lock is held, parentHash is in treeTable
+func (e *Engine) powDifficulty(parentHash string, opBlock bool) (difficulty uint8) {
+	return e.shiftedDifficulty(opBlock, e.treeTable[parentHash].DifficultyShift)
+}
+
+// Return the difficulty in leading zero bits, as the proof of work algorithm
+// requires it, of a block of the given type under a difficulty shift.
+// The bits stay within the range a hash can meet, see MaxDifficultyBits.
+func (e *Engine) shiftedDifficulty(opBlock bool, shift int) uint8 {
+	bits := e.Settings.DifficultyBits(opBlock) + shift
+	if bits < 0 {
+		bits = 0
+	}
+	if maxBits := e.Settings.MaxDifficultyBits(); bits > maxBits {
+		bits = maxBits
+	}
+	return e.pow.Difficulty(uint8(bits))
+}
+
+// Return the least difficulty, as the proof of work algorithm requires it,
+// of a block whose parent is not in the tree, so the retarget shift it was
+// mined under is unknown: the configured difficulty, or the longest chain's
+// if the network lowered it. A block mined after the network lowered it
+// further is refused.
+// Precondition: e.lock is held
+func (e *Engine) orphanDifficulty(opBlock bool) uint8 {
+	shift := e.treeTable[e.longestLeafHash].DifficultyShift
+	if shift > 0 {
+		shift = 0
+	}
+	return e.shiftedDifficulty(opBlock, shift)
+}
+
+// Return the difficulty shift in effect for the children of a new node
+// at height extending parent, see retargetShift
+// Precondition: e.lock is held
+func (e *Engine) difficultyShift(parent *BlockChainNode, block Block, height int) int {
+	return e.retargetShift(parent.DifficultyShift, block.GetTimestamp(), height, func(startHeight int) int64 {
+		start := parent
+		for start.Height > startHeight {
+			start = e.treeTable[start.Block.GetPrevHash()]
+		}
+		return start.Block.GetTimestamp()
+	})
+}
+
+// Return the difficulty shift in effect for the children of a block at
+// height with the given timestamp, whose parent's shift is parentShift.
+// Every RetargetInterval blocks, the time the last interval took is
+// compared against TargetBlockInterval per block.
+// timestampAt returns the timestamp of the block's ancestor at a height.
+func (e *Engine) retargetShift(parentShift int, timestamp int64, height int, timestampAt func(height int) int64) int {
+	interval := int(e.Settings.RetargetInterval)
+	if interval == 0 || height%interval != 0 {
+		return parentShift
+	}
+
+	// Genesis has no timestamp, measure from the first block at the latest
+	startHeight := height - interval
+	if startHeight < 1 {
+		startHeight = 1
+	}
+	if startHeight == height {
+		return parentShift
+	}
+
+	actual := timestamp - timestampAt(startHeight)
+	target := int64(height-startHeight) * int64(e.Settings.TargetBlockInterval)
+	shift := parentShift + RetargetSteps(actual, target)
+
+	// Keep both block types within the range a hash can meet
+	low, high := e.Settings.DifficultyBits(true), e.Settings.DifficultyBits(false)
+	if low > high {
+		low, high = high, low
+	}
+	maxDifficulty := e.Settings.MaxDifficultyBits()
+	if low+shift < 1 {
+		shift = 1 - low
+	}
+	if high+shift > maxDifficulty {
+		shift = maxDifficulty - high
+	}
+
+	if shift != parentShift {
+		Log.Debug("Retarget at height [%d]: [%d] ms for [%d] ms target, difficulty shift [%d] -> [%d]",
+			height, actual, target, parentShift, shift)
+	}
+	return shift
+}
+
+// Return the number of difficulty steps to move so that blocks that took
+// actual milliseconds would take target: the nearest power of the step
+// factor, limited to maxRetargetSteps either way
+func RetargetSteps(actual, target int64) int {
+	if target <= 0 {
+		return 0
+	}
+	if actual < 1 {
+		actual = 1
+	}
+
+	steps := int(math.Floor(math.Log(float64(target)/float64(actual))/math.Log(difficultyStepFactor) + 0.5))
+	if steps > maxRetargetSteps {
+		steps = maxRetargetSteps
+	}
+	if steps < -maxRetargetSteps {
+		steps = -maxRetargetSteps
+	}
+	return steps
+}
+
+// Return the median timestamp of the last medianTimeBlocks blocks up to
+// and including parentHash. The next block's timestamp must be later.
+// Precondition: e.lock is held, parentHash is in treeTable
+func (e *Engine) medianTimePast(parentHash string) int64 {
+	var timestamps []int64
+	node := e.treeTable[parentHash]
+	for len(timestamps) < medianTimeBlocks && node.Height > 0 {
+		timestamps = append(timestamps, node.Block.GetTimestamp())
+		node = e.treeTable[node.Block.GetPrevHash()]
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// Return true if the block's timestamp is later than the median time of
+// its ancestors and not too far ahead of our clock
+// Precondition: e.lock is held, the block's parent is in treeTable
+func (e *Engine) validTimestamp(block Block) bool {
+	timestamp := block.GetTimestamp()
+	if timestamp <= e.medianTimePast(block.GetPrevHash()) {
+		return false
+	}
+	return timestamp <= BlockTimestamp(time.Now().Add(maxFutureDrift))
+}
+
+func isOpBlock(block Block) bool {
+	_, ok := block.(OpBlock)
+	return ok
+}
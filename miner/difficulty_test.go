@@ -0,0 +1,93 @@
+package miner
+
+import (
+	"../shared"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetargetSteps(t *testing.T) {
+	cases := []struct {
+		actual, target int64
+		steps          int
+	}{
+		{1000, 1000, 0},
+		{750, 1000, 0}, // within a factor sqrt(2) either way
+		{1400, 1000, 0},
+		{500, 1000, 1},   // blocks 2x too fast: one bit harder
+		{2000, 1000, -1}, // blocks 2x too slow: one bit easier
+		{50, 1000, 2},    // two bits at most
+		{20000, 1000, -2},
+		{0, 1000, 2},
+		{1000, 0, 0},
+	}
+	for _, c := range cases {
+		if steps := RetargetSteps(c.actual, c.target); steps != c.steps {
+			t.Errorf("RetargetSteps(%d, %d) = %d, want %d", c.actual, c.target, steps, c.steps)
+		}
+	}
+}
+
+// Blocks found much faster than the target interval raise the difficulty
+func TestRetargetRaisesDifficulty(t *testing.T) {
+	settings := testSettings
+	settings.PoWDifficultyOpBlock = 2
+	settings.PoWDifficultyNoOpBlock = 2
+	settings.PoWDifficultyInBits = true
+	settings.RetargetInterval = 4
+	settings.TargetBlockInterval = 1000
+
+	e, _ := newTestEngine(t, settings)
+	defer os.RemoveAll(e.DataDir)
+	defer e.Stop()
+	if err, _ := e.InitBlockchain(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		e.lock.RLock()
+		difficulty := e.powDifficulty(e.longestLeafHash, false)
+		e.lock.RUnlock()
+		if difficulty > 2 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("difficulty not raised after [%d] blocks", len(e.GetLongestChain()))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// A difficulty past the hash width is refused, and a shift never takes the
+// difficulty past it, instead of wrapping around a uint8
+func TestDifficultyWithinHashWidth(t *testing.T) {
+	settings := testSettings
+	settings.PoWDifficultyOpBlock = 60
+	e, _ := newTestEngine(t, settings)
+	defer os.RemoveAll(e.DataDir)
+
+	for _, c := range []struct {
+		version shared.BlockVersion
+		digits  uint8
+	}{
+		{shared.BlockVersion1, 33},
+		{shared.BlockVersion2, 64},
+	} {
+		settings := testSettings
+		settings.BlockVersion = c.version
+		settings.PoWDifficultyOpBlock = c.digits
+		if _, err := NewEngine(settings, e.PrivKey, NewRPCTransport(), e.DataDir); err == nil {
+			t.Errorf("version [%d]: [%d] hex digits accepted", c.version, c.digits)
+		}
+	}
+
+	if difficulty := e.shiftedDifficulty(true, 40); difficulty != 255 {
+		t.Errorf("shifted difficulty is [%d], want 255", difficulty)
+	}
+	if difficulty := e.shiftedDifficulty(false, -40); difficulty != 0 {
+		t.Errorf("shifted difficulty is [%d], want 0", difficulty)
+	}
+}
@@ -0,0 +1,197 @@
+package miner
+
+import (
+	"../shared"
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// One miner: its blockchain, op queue, keys and connection to the network.
+// Several engines can run in the same process, each with its own transport.
+type Engine struct {
+	// Settings of the BlockArt network, received from the server
+	Settings MinerNetSettings
+
+	PrivKey   *ecdsa.PrivateKey
+	PubKeyStr string
+
+	// Connections to neighbouring miners
+	Transport Transport
+
+	// Block and op hashes seen by the miner and its neighbours
+	inv *inventory
+
+	// Calls waiting to be sent to each neighbour, see sendToPeer
+	outbound *outbound
+
+	// Announcements waiting to be fetched from each neighbour, see receiveInv
+	inbound *inbound
+
+	// Challenges sent to dialing miners, see Hello
+	challenges *challenges
+
+	// Proof of work algorithm selected by Settings.PoWAlgorithm
+	pow PoW
+
+	// Directory holding the miner's block store
+	DataDir string
+
+	// IP:Port the art node rpc server listens on
+	ArtIPPort string
+
+	// IP:Port the miner-miner rpc server listens on, handed to new neighbours
+	MinerIPPort string
+
+	// Guards every field below. Methods that take the lock must not call
+	// each other while holding it, and no network call is made under it,
+	// since the neighbour being called may be flooding back to us.
+	lock sync.RWMutex
+
+	// Hash tree that represents the blockchain data structure
+	// Key: the Block's hash
+	// Value: BlockChainNode pointer
+	treeTable map[string]*BlockChainNode
+
+	// The block key to longest chain's leaf in treeTable
+	// This is the block the miner extends.
+	longestLeafHash string
+
+	// Operations queues to be added to block
+	// Precondition: op is valid
+	opQueue map[string]*Op
+
+	// Order ops arrived in opQueue, see enqueueOp
+	// Key: op hash
+	opArrival    map[string]uint64
+	arrivalCount uint64
+
+	// Holds the blocks waiting to be disseminated once
+	// miner is initialized
+	blockWaitQ []Block
+
+	// Holds the blocks we can't recognize the prevHash of
+	orphans *orphanPool
+
+	// On-disk log of every block in treeTable, reloaded on restart
+	blockStore *BlockStore
+
+	// Cancels the nonce search of the block being mined
+	cancelMining context.CancelFunc
+
+	// Set by PauseMining, Mine waits on miningResumed while it is true
+	miningPaused  bool
+	miningResumed *sync.Cond
+
+	// Set by Stop, stop is closed then to end Mine and dequeueBlocks
+	stopped bool
+	stop    chan struct{}
+
+	// Mine and dequeueBlocks, waited for by Stop
+	loops sync.WaitGroup
+
+	// Expected work of the blocks sealed so far and the time spent
+	// searching for nonces, see HashRate
+	sealedWork  *big.Int
+	sealingTime time.Duration
+
+	// Receivers of the chain events, see Subscribe
+	subscribers      map[uint64]chan ChainEvent
+	nextSubscriberID uint64
+
+	// Number of blocks added to the tree so far, used to order tips by arrival
+	seenCounter uint64
+
+	// Indicate whether the block chain is successfully initialized
+	initialized bool
+}
+
+// Create a miner for the network described by settings, signing with privKey
+// and talking to other miners through transport.
+// The blockchain is not loaded until InitBlockchain is called.
+func NewEngine(settings MinerNetSettings, privKey *ecdsa.PrivateKey, transport Transport, dataDir string) (e *Engine, err error) {
+	pubKeyStr, err := shared.EncodePubKey(privKey.PublicKey)
+	if err != nil {
+		return
+	}
+
+	if settings.BlockVersion == 0 {
+		settings.BlockVersion = shared.BlockVersion1
+	}
+	if !settings.BlockVersion.Valid() {
+		return nil, fmt.Errorf("unsupported block version [%d]", settings.BlockVersion)
+	}
+	for _, opBlock := range []bool{true, false} {
+		if bits := settings.DifficultyBits(opBlock); bits > settings.MaxDifficultyBits() {
+			return nil, fmt.Errorf("difficulty of [%d] bits exceeds the [%d] bits a block hash can meet", bits, settings.MaxDifficultyBits())
+		}
+	}
+	pow, err := NewPoW(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	e = &Engine{
+		Settings:        settings,
+		PrivKey:         privKey,
+		PubKeyStr:       pubKeyStr,
+		Transport:       transport,
+		inv:             newInventory(),
+		outbound:        newOutbound(),
+		inbound:         newInbound(),
+		challenges:      newChallenges(),
+		pow:             pow,
+		DataDir:         dataDir,
+		treeTable:       make(map[string]*BlockChainNode),
+		longestLeafHash: settings.GenesisBlockHash,
+		opQueue:         make(map[string]*Op),
+		opArrival:       make(map[string]uint64),
+		blockWaitQ:      make([]Block, 0),
+		orphans:         newOrphanPool(),
+		subscribers:     make(map[uint64]chan ChainEvent),
+		sealedWork:      new(big.Int),
+		stop:            make(chan struct{}),
+	}
+	e.miningResumed = sync.NewCond(&e.lock)
+
+	// Add Genesis block to tree table
+	GenesisNode := BlockChainNode{
+		Block:      NoOpBlock{},
+		Children:   []string{},
+		Height:     0,
+		TotalWork:  new(big.Int),
+		ChainState: NewChainState(),
+	}
+	e.treeTable[e.longestLeafHash] = &GenesisNode
+
+	return e, nil
+}
+
+// Stop mining and fetching the ancestors of orphans, wait for both to end,
+// then close the block store. Blocks added afterwards are not persisted.
+// A stopped engine can't be started again.
+func (e *Engine) Stop() {
+	e.lock.Lock()
+	if e.stopped {
+		e.lock.Unlock()
+		return
+	}
+	e.stopped = true
+	close(e.stop)
+	e.interruptMining()
+	e.miningResumed.Broadcast()
+	e.lock.Unlock()
+
+	e.loops.Wait()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.blockStore != nil {
+		if err := e.blockStore.Close(); err != nil {
+			Log.Error("failed to close block store [%s]", err.Error())
+		}
+	}
+}
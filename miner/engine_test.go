@@ -0,0 +1,341 @@
+package miner
+
+import (
+	"../shared"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The logger is silenced once for the whole package
+func TestMain(m *testing.M) {
+	Log = shared.NewLogger(false, false, false)
+	os.Exit(m.Run())
+}
+
+// Start an engine serving MinerMinerRPC on a loopback port
+func newTestEngine(t *testing.T, settings MinerNetSettings) (e *Engine, ipPort string) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir, err := ioutil.TempDir("", "engine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = NewEngine(settings, privKey, NewRPCTransport(), dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ServeRPC(listener, NewMinerMinerRPC(e)); err != nil {
+		t.Fatal(err)
+	}
+	e.MinerIPPort = listener.Addr().String()
+	return e, e.MinerIPPort
+}
+
+var testSettings = MinerNetSettings{
+	GenesisBlockHash:       "83218ac34c1834c26781fe4bde918ee4",
+	InkPerOpBlock:          50,
+	InkPerNoOpBlock:        100,
+	PoWDifficultyOpBlock:   3,
+	PoWDifficultyNoOpBlock: 3,
+	BlockVersion:           shared.BlockVersion2,
+	CanvasSettings:         shared.CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024},
+}
+
+// Sign a circle owned by the engine's miner, the same way AddShapeToBlockChain does
+func testOp(t *testing.T, e *Engine, x int, validNum uint8) Op {
+	shape := Shape{
+		Owner:     e.PubKeyStr,
+		ShapeType: shared.CIRC,
+		Svg:       fmt.Sprintf("cx %d cy %d r 2", x, x),
+		Fill:      "transparent",
+		Stroke:    "red",
+		Version:   e.Settings.BlockVersion,
+	}
+	return signTestOp(t, e, Op{Op: shape, PubKey: e.PubKeyStr, ValidNum: validNum, Add: true})
+}
+
+// Sign op with the engine's miner key
+func signTestOp(t *testing.T, e *Engine, op Op) Op {
+	r, s, err := ecdsa.Sign(rand.Reader, e.PrivKey, op.SignedBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	op.OpSig = shared.OpenArgs{r, s}
+	return op
+}
+
+// Several engines in one process flood blocks and ops at each other while
+// art node calls read their state. Run with -race.
+func TestEngineConcurrentTraffic(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mines for a few seconds")
+	}
+	settings := testSettings
+
+	const numEngines = 3
+	engines := make([]*Engine, numEngines)
+	addrs := make([]string, numEngines)
+	for i := range engines {
+		engines[i], addrs[i] = newTestEngine(t, settings)
+		defer os.RemoveAll(engines[i].DataDir)
+		defer engines[i].Stop()
+	}
+	for i, e := range engines {
+		for j, other := range engines {
+			if i == j {
+				continue
+			}
+			peer, err := e.Transport.Dial(addrs[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Transport.AddNeighbour(other.PubKeyStr, peer)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, e := range engines {
+		wg.Add(1)
+		go func(e *Engine) {
+			defer wg.Done()
+			if err, _ := e.InitBlockchain(); err != nil {
+				t.Error(err)
+			}
+		}(e)
+	}
+	wg.Wait()
+
+	stop := make(chan struct{})
+	for i, e := range engines {
+		// Art node reads
+		wg.Add(1)
+		go func(e *Engine) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				leaf := e.LongestLeafHash()
+				e.GetInk(e.PubKeyStr)
+				e.GetShapes(leaf)
+				e.GetChildren(settings.GenesisBlockHash)
+				for _, block := range e.GetLongestChain() {
+					for _, op := range block.GetOps() {
+						e.GetSVGFields(op.HashToString())
+					}
+				}
+			}
+		}(e)
+
+		// Ops flooded to the network
+		wg.Add(1)
+		go func(e *Engine, offset int) {
+			defer wg.Done()
+			for x := 10 + offset*300; ; x += 5 {
+				select {
+				case <-stop:
+					return
+				case <-time.After(50 * time.Millisecond):
+				}
+				e.DisseminateOp(testOp(t, e, x, 1))
+			}
+		}(e, i)
+	}
+
+	time.Sleep(3 * time.Second)
+	close(stop)
+	wg.Wait()
+
+	for i, e := range engines {
+		chain := e.GetLongestChain()
+		if len(chain) == 0 {
+			t.Errorf("engine [%d] mined no blocks", i)
+		}
+		prevHash := settings.GenesisBlockHash
+		for _, block := range chain {
+			if block.GetPrevHash() != prevHash {
+				t.Fatalf("engine [%d] longest chain is not linked at [%s]", i, block.Hash())
+			}
+			prevHash = block.Hash()
+		}
+	}
+}
+
+// Ops are reported as soon as they reach their confirmation depth
+func TestAddOpConfirmation(t *testing.T) {
+	e, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(e.DataDir)
+	defer e.Stop()
+	if err, _ := e.InitBlockchain(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mine some ink first
+	for e.GetInk(e.PubKeyStr) < 1000 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, validNum := range []uint8{0, 1, 3} {
+		op := testOp(t, e, 100+50*i, validNum)
+		opHash, blockHash, _, err := e.AddOpToBlockChain(validNum, op)
+		if err != nil {
+			t.Fatalf("validNum [%d]: %v", validNum, err)
+		}
+
+		confirmedIn, confirmed := e.OpConfirmation(opHash)
+		if !confirmed || confirmedIn != blockHash {
+			t.Errorf("validNum [%d]: op should be confirmed in [%s], got [%s]", validNum, blockHash, confirmedIn)
+		}
+		svg, err := e.GetSVGFields(opHash)
+		if err != nil || svg == "" {
+			t.Errorf("validNum [%d]: shape not on canvas [%v]", validNum, err)
+		}
+
+		info, err := e.GetOpInfo(opHash)
+		if err != nil || info.BlockHash != blockHash || info.Confirmations < int(validNum) {
+			t.Errorf("validNum [%d]: explorer reports op in [%s] with [%d] confirmations [%v]", validNum, info.BlockHash, info.Confirmations, err)
+		}
+
+		header, err := e.GetBlockHeader(blockHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := e.GetOpProof(opHash)
+		if err != nil || !shared.VerifyOpProof(header, proof) {
+			t.Errorf("validNum [%d]: Merkle proof of op in [%s] does not verify [%v]", validNum, blockHash, err)
+		}
+
+		// Submitting it again returns right away
+		_, again, _, err := e.AddOpToBlockChain(validNum, op)
+		if err != nil || again != blockHash {
+			t.Errorf("validNum [%d]: resubmitted op not confirmed in [%s], got [%s] [%v]", validNum, blockHash, again, err)
+		}
+	}
+}
+
+// Stop ends mining and the orphan fetching loop, and closes the block store
+func TestEngineStop(t *testing.T) {
+	e, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(e.DataDir)
+	if err, _ := e.InitBlockchain(); err != nil {
+		t.Fatal(err)
+	}
+	for len(e.GetLongestChain()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		e.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stop did not return")
+	}
+	e.Stop()
+
+	height := len(e.GetLongestChain())
+	time.Sleep(200 * time.Millisecond)
+	if len(e.GetLongestChain()) != height {
+		t.Errorf("engine mined after Stop")
+	}
+	if err := e.blockStore.Append(e.GetLongestChain()[0]); err == nil {
+		t.Errorf("block store still open after Stop")
+	}
+}
+
+// Transport carrying MinerMinerRPC calls over in-memory pipes, to engines
+// registered under a name instead of an IP:Port
+type pipeTransport struct {
+	*RPCTransport
+	servers map[string]*rpc.Server
+}
+
+func (t *pipeTransport) Dial(name string) (Peer, error) {
+	server, exists := t.servers[name]
+	if !exists {
+		return nil, fmt.Errorf("no engine [%s]", name)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	return rpc.NewClient(clientConn), nil
+}
+
+// Several engines run in one process, each with its own chain, and talk
+// through whatever Transport they are given
+func TestEnginesInOneProcess(t *testing.T) {
+	settings := testSettings
+	settings.PoWAlgorithm = PoWDev
+	servers := make(map[string]*rpc.Server)
+
+	var engines []*Engine
+	for _, name := range []string{"a", "b", "c"} {
+		privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataDir, err := ioutil.TempDir("", "engine_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dataDir)
+
+		transport := &pipeTransport{RPCTransport: NewRPCTransport(), servers: servers}
+		e, err := NewEngine(settings, privKey, transport, dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.Stop()
+		if e.blockStore, err = OpenBlockStore(dataDir); err != nil {
+			t.Fatal(err)
+		}
+		e.initialized = true
+		e.MinerIPPort = name
+		servers[name] = rpc.NewServer()
+		if err = servers[name].Register(NewMinerMinerRPC(e)); err != nil {
+			t.Fatal(err)
+		}
+		engines = append(engines, e)
+	}
+	a, b, c := engines[0], engines[1], engines[2]
+
+	if _, err := a.ConnectPeer("b"); err != nil {
+		t.Fatal(err)
+	}
+	block := NoOpBlock{Version: settings.BlockVersion, PrevHash: settings.GenesisBlockHash, PubKeyMiner: a.PubKeyStr, Timestamp: BlockTimestamp(time.Now())}
+	if err := a.DisseminateBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.HasBlock(block.Hash()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !b.HasBlock(block.Hash()) {
+		t.Errorf("block not flooded to the neighbour")
+	}
+	if c.HasBlock(block.Hash()) || c.GetInk(a.PubKeyStr) != 0 {
+		t.Errorf("engine not connected to the others shares their chain")
+	}
+}
@@ -0,0 +1,159 @@
+package miner
+
+// Kind of change to the longest chain
+type ChainEventType uint8
+
+const (
+	// A block joined the longest chain
+	BlockConnected ChainEventType = iota
+	// A block left the longest chain in a reorg
+	BlockDisconnected
+	// An op's block reached the op's ValidNum confirmations,
+	// its shape is now added to/deleted from the canvas
+	OpConfirmed
+	// An op left the longest chain in a reorg, or the queue when the
+	// longest chain moved, it is no longer valid on the new longest chain
+	OpDropped
+)
+
+// Number of events a subscriber can fall behind before it is dropped
+const eventBufferSize = 256
+
+// Change to the longest chain, published by setLongestLeaf
+type ChainEvent struct {
+	Type ChainEventType
+
+	// Block connected or disconnected, or the block holding the confirmed op
+	BlockHash string
+
+	// OpConfirmed, OpDropped: the op
+	OpHash string
+
+	// OpConfirmed: number of blocks on top of BlockHash
+	Depth int
+
+	// OpDropped: reason the op is no longer valid
+	Err error
+}
+
+// Stream of chain events for one subscriber.
+// Events is closed if the subscriber falls more than eventBufferSize
+// events behind; the subscriber should then check the chain and Resubscribe.
+type Subscription struct {
+	id     uint64
+	Events <-chan ChainEvent
+}
+
+// Start receiving the chain events published from now on
+func (e *Engine) Subscribe() *Subscription {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	sub := &Subscription{}
+	e.subscribe(sub)
+	return sub
+}
+
+// Start receiving events again after sub.Events was closed
+func (e *Engine) Resubscribe(sub *Subscription) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.subscribe(sub)
+}
+
+// Precondition: e.lock is held for writing
+func (e *Engine) subscribe(sub *Subscription) {
+	e.nextSubscriberID++
+	events := make(chan ChainEvent, eventBufferSize)
+	e.subscribers[e.nextSubscriberID] = events
+	sub.id = e.nextSubscriberID
+	sub.Events = events
+}
+
+// Stop receiving chain events
+func (e *Engine) Unsubscribe(sub *Subscription) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if events, exists := e.subscribers[sub.id]; exists {
+		close(events)
+		delete(e.subscribers, sub.id)
+	}
+}
+
+// Send event to every subscriber without blocking
+// Precondition: e.lock is held for writing
+func (e *Engine) publish(event ChainEvent) {
+	for id, events := range e.subscribers {
+		select {
+		case events <- event:
+		default:
+			Log.Error("chain event subscriber [%d] fell behind, dropping it", id)
+			close(events)
+			delete(e.subscribers, id)
+		}
+	}
+}
+
+// Publish the events for the longest chain moving as described by reorg
+// Precondition: e.lock is held for writing, longestLeafHash is reorg.NewLeafHash
+func (e *Engine) publishReorg(reorg Reorg) {
+	for _, blockHash := range reorg.Disconnected {
+		e.publish(ChainEvent{Type: BlockDisconnected, BlockHash: blockHash})
+	}
+	for _, blockHash := range reorg.Connected {
+		e.publish(ChainEvent{Type: BlockConnected, BlockHash: blockHash})
+	}
+
+	// An op is confirmed once it is in the log and no longer queued.
+	// Ops that newly reach that point are either in a connected block,
+	// or were queued on the old leaf.
+	oldLeaf := e.treeTable[reorg.OldLeafHash]
+	newLeaf := e.treeTable[reorg.NewLeafHash]
+	confirmed := make(map[string]bool)
+	confirm := func(opHash, blockHash string) {
+		if confirmed[opHash] {
+			return
+		}
+		if _, inLog := newLeaf.OpLog.Get(opHash); !inLog {
+			return
+		}
+		if _, queued := newLeaf.QueueShapes[opHash]; queued {
+			return
+		}
+		confirmed[opHash] = true
+		e.publish(ChainEvent{
+			Type:      OpConfirmed,
+			BlockHash: blockHash,
+			OpHash:    opHash,
+			Depth:     newLeaf.Height - e.treeTable[blockHash].Height,
+		})
+	}
+
+	for _, blockHash := range reorg.Connected {
+		for _, op := range e.treeTable[blockHash].Block.GetOps() {
+			confirm(op.HashToString(), blockHash)
+		}
+	}
+	for opHash, queueShape := range oldLeaf.QueueShapes {
+		confirm(opHash, queueShape.BlockHash)
+	}
+}
+
+// Return the block holding the op if the op is confirmed on the longest chain
+func (e *Engine) OpConfirmation(opHash string) (blockHash string, confirmed bool) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	leaf := e.treeTable[e.longestLeafHash]
+	if _, inLog := leaf.OpLog.Get(opHash); !inLog {
+		return "", false
+	}
+	if _, queued := leaf.QueueShapes[opHash]; queued {
+		return "", false
+	}
+
+	blockHash, _, confirmed = e.findOp(opHash)
+	return blockHash, confirmed
+}
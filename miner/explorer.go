@@ -0,0 +1,205 @@
+package miner
+
+import (
+	"../shared"
+	"encoding/hex"
+)
+
+// ---------------------------------------------------------------------
+// Read-only views of the blockchain for art nodes and tooling
+// ---------------------------------------------------------------------
+
+// Return the header and op details of a block
+// Can return the following errors:
+// - InvalidBlockHashError
+func (e *Engine) GetBlockInfo(blockHash string) (info shared.BlockInfo, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	node, exists := e.treeTable[blockHash]
+	if !exists {
+		return info, shared.InvalidBlockHashError(blockHash)
+	}
+
+	block := node.Block
+	info = shared.BlockInfo{
+		Version:       block.GetVersion(),
+		Hash:          blockHash,
+		PrevHash:      block.GetPrevHash(),
+		MinerPubKey:   block.GetMinerPubKey(),
+		Nonce:         block.GetNonce(),
+		ExtraNonce:    block.GetExtraNonce(),
+		Timestamp:     block.GetTimestamp(),
+		Height:        node.Height,
+		IsOpBlock:     isOpBlock(block),
+		Confirmations: e.confirmations(blockHash),
+	}
+	if node.Height > 0 {
+		info.Difficulty = e.powDifficulty(block.GetPrevHash(), info.IsOpBlock)
+	}
+	for _, op := range block.GetOps() {
+		info.Ops = append(info.Ops, toOpInfo(op, blockHash, info.Confirmations))
+	}
+	return info, nil
+}
+
+// Return an op with its containing block and confirmation count.
+// Ops on the longest chain are found first, then ops on side branches,
+// then ops still waiting to be mined.
+// Can return the following errors:
+// - InvalidShapeHashError
+func (e *Engine) GetOpInfo(opHash string) (info shared.OpInfo, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if blockHash, index, found := e.findOp(opHash); found {
+		op := e.treeTable[blockHash].Block.GetOps()[index]
+		return toOpInfo(op, blockHash, e.confirmations(blockHash)), nil
+	}
+
+	if opPtr, queued := e.opQueue[opHash]; queued {
+		return toOpInfo(*opPtr, "", -1), nil
+	}
+
+	return info, shared.InvalidShapeHashError(opHash)
+}
+
+// Return the header of a block, which its hash commits to
+// Can return the following errors:
+// - InvalidBlockHashError
+func (e *Engine) GetBlockHeader(blockHash string) (header shared.BlockHeader, err error) {
+	block, err := e.GetBlock(blockHash)
+	if err != nil {
+		return header, err
+	}
+	return block.Header(), nil
+}
+
+// Return the Merkle branch linking a mined op to the header of its block,
+// preferring the block on the longest chain
+// Can return the following errors:
+// - InvalidShapeHashError
+func (e *Engine) GetOpProof(opHash string) (proof shared.OpProof, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	blockHash, index, found := e.findOp(opHash)
+	if !found {
+		return proof, shared.InvalidShapeHashError(opHash)
+	}
+
+	block := e.treeTable[blockHash].Block
+	leaves := OpMerkleLeaves(block.GetOps())
+	proof = shared.OpProof{
+		BlockHash: blockHash,
+		OpHash:    opHash,
+		Index:     index,
+	}
+	for _, sibling := range shared.MerkleBranch(block.GetVersion(), leaves, index) {
+		proof.Branch = append(proof.Branch, hex.EncodeToString(sibling))
+	}
+	return proof, nil
+}
+
+// Return the block holding the op and the op's position in it.
+// Ops on the longest chain are found first, then ops on side branches.
+// Precondition: e.lock is held
+func (e *Engine) findOp(opHash string) (blockHash string, index int, found bool) {
+	if _, onLongestChain := e.treeTable[e.longestLeafHash].OpLog.Get(opHash); onLongestChain {
+		for _, blockHash := range e.longestChainHashes() {
+			for i, op := range e.treeTable[blockHash].Block.GetOps() {
+				if op.HashToString() == opHash {
+					return blockHash, i, true
+				}
+			}
+		}
+	}
+
+	for blockHash, node := range e.treeTable {
+		for i, op := range node.Block.GetOps() {
+			if op.HashToString() == opHash {
+				return blockHash, i, true
+			}
+		}
+	}
+
+	return "", 0, false
+}
+
+// Return the spendable ink of every miner as of the block
+// Can return the following errors:
+// - InvalidBlockHashError
+func (e *Engine) GetInkTable(blockHash string) (inkTable map[string]uint32, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	node, exists := e.treeTable[blockHash]
+	if !exists {
+		return nil, shared.InvalidBlockHashError(blockHash)
+	}
+
+	// Copy, the art node reply is encoded after the lock is released
+	inkTable = make(map[string]uint32, len(node.InkTable))
+	for pubKey, ink := range node.InkTable {
+		inkTable[pubKey] = ink
+	}
+	return inkTable, nil
+}
+
+// Return the block hashes of the longest chain
+// Array order [Genesis, ... , leaf]
+func (e *Engine) GetLongestChainHashes() []string {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.longestChainHashes()
+}
+
+// Same as GetLongestChainHashes, with e.lock held
+func (e *Engine) longestChainHashes() []string {
+	leaf := e.treeTable[e.longestLeafHash]
+	hashes := make([]string, leaf.Height+1)
+	hash := e.longestLeafHash
+	for height := leaf.Height; height >= 0; height-- {
+		hashes[height] = hash
+		hash = e.treeTable[hash].Block.GetPrevHash()
+	}
+	return hashes
+}
+
+// Return the number of blocks on top of the block on the longest chain,
+// -1 if the block is on a side branch
+// Precondition: e.lock is held, the block is in treeTable
+func (e *Engine) confirmations(blockHash string) int {
+	leaf := e.treeTable[e.longestLeafHash]
+	node := e.treeTable[blockHash]
+
+	// Walk down the longest chain to the block's height
+	hash := e.longestLeafHash
+	for height := leaf.Height; height > node.Height; height-- {
+		hash = e.treeTable[hash].Block.GetPrevHash()
+	}
+	if hash != blockHash {
+		return -1
+	}
+	return leaf.Height - node.Height
+}
+
+func toOpInfo(op Op, blockHash string, confirmations int) shared.OpInfo {
+	return shared.OpInfo{
+		OpHash:        op.HashToString(),
+		ShapeHash:     op.Op.HashToString(),
+		Add:           op.Add,
+		ShapeType:     op.Op.ShapeType,
+		Svg:           op.Op.Svg,
+		Fill:          op.Op.Fill,
+		Stroke:        op.Op.Stroke,
+		Owner:         op.Op.Owner,
+		Signer:        op.PubKey,
+		ValidNum:      op.ValidNum,
+		Fee:           op.Fee,
+		InkCost:       ShapeInk(op.Op),
+		BlockHash:     blockHash,
+		Confirmations: confirmations,
+	}
+}
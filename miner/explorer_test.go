@@ -0,0 +1,107 @@
+package miner
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// Blocks on a side branch have no confirmations, each block reports the
+// difficulty of its type and its height, and ink tables are per block
+func TestExplorer(t *testing.T) {
+	settings := testSettings
+	settings.PoWDifficultyInBits = true
+	settings.PoWDifficultyOpBlock, settings.PoWDifficultyNoOpBlock = 3, 5
+	e := newTestEngineWithInk(t, settings, 0)
+	defer os.RemoveAll(e.DataDir)
+	other, _ := newTestEngine(t, settings)
+	defer os.RemoveAll(other.DataDir)
+	// Weighs blocks by the difficulty of their type
+	e.pow = &gatedPoW{}
+
+	timestamp := BlockTimestamp(time.Now())
+	addBlock := func(block Block) string {
+		e.AddBlockToBlockchain(block)
+		if !e.HasBlock(block.Hash()) {
+			t.Fatalf("block [%s] not added", block.Hash())
+		}
+		return block.Hash()
+	}
+
+	// Genesis <- first <- second <- opBlock, and first <- side
+	first := addBlock(NoOpBlock{Version: settings.BlockVersion, PrevHash: settings.GenesisBlockHash, PubKeyMiner: e.PubKeyStr, Timestamp: timestamp + 1})
+	second := addBlock(NoOpBlock{Version: settings.BlockVersion, PrevHash: first, PubKeyMiner: e.PubKeyStr, Timestamp: timestamp + 2})
+	op := testOp(t, e, 100, 0)
+	opBlock := addBlock(OpBlock{Version: settings.BlockVersion, PrevHash: second, Ops: []Op{op}, PubKeyMiner: other.PubKeyStr, Timestamp: timestamp + 3})
+	side := addBlock(NoOpBlock{Version: settings.BlockVersion, PrevHash: first, PubKeyMiner: other.PubKeyStr, Timestamp: timestamp + 4})
+
+	longest := []string{settings.GenesisBlockHash, first, second, opBlock}
+	hashes := e.GetLongestChainHashes()
+	if len(hashes) != len(longest) {
+		t.Fatalf("longest chain has [%d] blocks, want [%d]", len(hashes), len(longest))
+	}
+	for i, hash := range longest {
+		if hashes[i] != hash {
+			t.Errorf("block [%d] of the longest chain is [%s], want [%s]", i, hashes[i], hash)
+		}
+	}
+
+	for _, c := range []struct {
+		hash          string
+		height        int
+		opBlock       bool
+		difficulty    uint8
+		confirmations int
+	}{
+		{first, 1, false, 5, 2},
+		{second, 2, false, 5, 1},
+		{opBlock, 3, true, 3, 0},
+		{side, 2, false, 5, -1},
+	} {
+		info, err := e.GetBlockInfo(c.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Hash != c.hash || info.Height != c.height || info.IsOpBlock != c.opBlock || info.Difficulty != c.difficulty || info.Confirmations != c.confirmations {
+			t.Errorf("block [%s]: got height [%d], op block [%t], difficulty [%d], confirmations [%d]",
+				c.hash, info.Height, info.IsOpBlock, info.Difficulty, info.Confirmations)
+		}
+	}
+
+	info, _ := e.GetBlockInfo(opBlock)
+	if len(info.Ops) != 1 || info.Ops[0].OpHash != op.HashToString() || info.Ops[0].BlockHash != opBlock {
+		t.Errorf("ops of the op block [%+v]", info.Ops)
+	}
+	if _, err := e.GetBlockInfo("unknown"); err == nil {
+		t.Errorf("info of an unknown block returned")
+	}
+
+	// Ink as of each block, not of the longest leaf
+	cost := ShapeInk(op.Op)
+	for _, c := range []struct {
+		hash          string
+		ink, otherInk uint32
+	}{
+		{first, settings.InkPerNoOpBlock, 0},
+		{second, 2 * settings.InkPerNoOpBlock, 0},
+		{opBlock, 2*settings.InkPerNoOpBlock - cost, settings.InkPerOpBlock},
+		{side, settings.InkPerNoOpBlock, settings.InkPerNoOpBlock},
+	} {
+		inkTable, err := e.GetInkTable(c.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inkTable[e.PubKeyStr] != c.ink || inkTable[other.PubKeyStr] != c.otherInk {
+			t.Errorf("block [%s]: ink [%d] and [%d], want [%d] and [%d]",
+				c.hash, inkTable[e.PubKeyStr], inkTable[other.PubKeyStr], c.ink, c.otherInk)
+		}
+		// A copy, the block's table is left alone
+		inkTable[e.PubKeyStr] = 0
+	}
+	if inkTable, _ := e.GetInkTable(first); inkTable[e.PubKeyStr] != settings.InkPerNoOpBlock {
+		t.Errorf("ink table of the block changed through the returned one")
+	}
+	if _, err := e.GetInkTable("unknown"); err == nil {
+		t.Errorf("ink table of an unknown block returned")
+	}
+}
@@ -0,0 +1,49 @@
+package miner
+
+import (
+	"math/big"
+)
+
+// Rule to pick between two tips with the same cumulative work
+type ForkChoicePolicy uint8
+
+const (
+	// Keep the tip that was added to the tree first
+	FirstSeen ForkChoicePolicy = iota
+	// Keep the tip with the lexicographically lowest block hash
+	LowestHash
+)
+
+// Expected number of hashes needed to find a nonce for the difficulty:
+// each leading zero bit halves the chance, so 2^difficulty
+func BlockWork(difficulty uint8) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+// Return the cumulative work of a new node extending parent with a block
+// of the given difficulty
+func ChainWork(parent *BlockChainNode, difficulty uint8) *big.Int {
+	return new(big.Int).Add(parent.TotalWork, BlockWork(difficulty))
+}
+
+// Return true if candidate should replace current as the longest leaf.
+// The tip with more cumulative work wins; ties are broken by the policy,
+// so every miner that has seen the same blocks picks the same tip.
+func (policy ForkChoicePolicy) BetterTip(candidate, current *BlockChainNode) bool {
+	switch cmp := candidate.TotalWork.Cmp(current.TotalWork); {
+	case cmp > 0:
+		return true
+	case cmp < 0:
+		return false
+	}
+
+	switch policy {
+	case LowestHash:
+		return candidate.Block.Hash() < current.Block.Hash()
+	case FirstSeen:
+		return candidate.SeenOrder < current.SeenOrder
+	default:
+		Log.Error("unknown fork choice policy [%d]", policy)
+		return false
+	}
+}
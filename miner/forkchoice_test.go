@@ -0,0 +1,49 @@
+package miner
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestBetterTip(t *testing.T) {
+	light := &BlockChainNode{Block: NoOpBlock{Nonce: 1}, TotalWork: big.NewInt(16), SeenOrder: 1}
+	heavy := &BlockChainNode{Block: NoOpBlock{Nonce: 2}, TotalWork: big.NewInt(256), SeenOrder: 2}
+	first := &BlockChainNode{Block: NoOpBlock{Nonce: 3}, TotalWork: big.NewInt(256), SeenOrder: 3}
+	second := &BlockChainNode{Block: NoOpBlock{Nonce: 4}, TotalWork: big.NewInt(256), SeenOrder: 4}
+
+	for _, policy := range []ForkChoicePolicy{FirstSeen, LowestHash} {
+		if !policy.BetterTip(heavy, light) {
+			t.Errorf("policy [%d]: more work should win", policy)
+		}
+		if policy.BetterTip(light, heavy) {
+			t.Errorf("policy [%d]: less work should lose", policy)
+		}
+		if policy.BetterTip(first, first) {
+			t.Errorf("policy [%d]: a tip is not better than itself", policy)
+		}
+		if policy.BetterTip(first, second) == policy.BetterTip(second, first) {
+			t.Errorf("policy [%d]: tie must be broken one way", policy)
+		}
+	}
+
+	if !FirstSeen.BetterTip(first, second) {
+		t.Errorf("FirstSeen should keep the tip seen first")
+	}
+
+	lower, higher := first, second
+	if second.Block.Hash() < first.Block.Hash() {
+		lower, higher = second, first
+	}
+	if !LowestHash.BetterTip(lower, higher) {
+		t.Errorf("LowestHash should keep the tip with the lowest hash")
+	}
+}
+
+func TestBlockWork(t *testing.T) {
+	if BlockWork(0).Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("difficulty 0 should be 1 unit of work")
+	}
+	if BlockWork(20).Cmp(big.NewInt(1<<20)) != 0 {
+		t.Errorf("difficulty 20 should be 2^20 units of work")
+	}
+}
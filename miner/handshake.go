@@ -0,0 +1,220 @@
+package miner
+
+import (
+	"../shared"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Miner-miner handshake: the dialing miner sends Hello with its challenge,
+// the answering miner replies with its own. The dialing miner signs the
+// session they define (both keys, addresses and challenges) in Connect, and
+// only once that checks out does the answering miner sign it back. Neither
+// miner signs for a peer that has not proven its key, and a signature is
+// only good for its own session. Miners of another protocol version or
+// network refuse to pair.
+// ---------------------------------------------------------------------
+
+const (
+	// How long a dialing miner has to sign the session of a Hello reply
+	handshakeTimeout = 30 * time.Second
+
+	// Most sessions waiting for the dialing miner's signature
+	maxPendingChallenges = 1024
+)
+
+// Sessions opened by Hello replies, waiting for the dialing miner's signature
+type challenges struct {
+	lock sync.Mutex
+
+	// Key: hex encoded challenge of the Hello reply
+	pending map[string]pendingSession
+}
+
+type pendingSession struct {
+	session shared.HandshakeSession
+	expiry  time.Time
+}
+
+func newChallenges() *challenges {
+	return &challenges{pending: make(map[string]pendingSession)}
+}
+
+// Store a session, keyed by our challenge, so no other miner can replace it.
+// Return false if too many sessions are waiting.
+func (c *challenges) add(session shared.HandshakeSession, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for key, pending := range c.pending {
+		if now.After(pending.expiry) {
+			delete(c.pending, key)
+		}
+	}
+	if len(c.pending) >= maxPendingChallenges {
+		return false
+	}
+	c.pending[hex.EncodeToString(session.AnswererChallenge)] = pendingSession{session: session, expiry: now.Add(handshakeTimeout)}
+	return true
+}
+
+// Remove and return the session opened with challenge, if it has not
+// expired. A session is signed once.
+func (c *challenges) take(challenge []byte, now time.Time) (session shared.HandshakeSession, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := hex.EncodeToString(challenge)
+	pending, exists := c.pending[key]
+	delete(c.pending, key)
+	if !exists || now.After(pending.expiry) {
+		return session, false
+	}
+	return pending.session, true
+}
+
+// Return an error unless the other miner runs our protocol version on our network
+// Can return the following errors:
+// - HandshakeError
+func (e *Engine) checkNetwork(version uint32, genesisHash string) error {
+	if version != shared.ProtocolVersion {
+		return shared.HandshakeError("unsupported protocol version")
+	}
+	if genesisHash != e.Settings.GenesisBlockHash {
+		return shared.HandshakeError("different genesis block")
+	}
+	return nil
+}
+
+// Answer a dialing miner's Hello with our challenge. Nothing is signed yet.
+// Can return the following errors:
+// - HandshakeError
+func (e *Engine) Hello(args shared.HelloArgs) (reply shared.HelloReply, err error) {
+	if err = e.checkNetwork(args.Version, args.GenesisHash); err != nil {
+		return reply, err
+	}
+	if _, err = shared.DecodePubKey(args.PubKey); err != nil || len(args.Challenge) != shared.ChallengeSize || args.IPPort == "" {
+		return reply, shared.HandshakeError("bad hello")
+	}
+
+	reply = shared.HelloReply{
+		Version:     shared.ProtocolVersion,
+		GenesisHash: e.Settings.GenesisBlockHash,
+		PubKey:      e.PubKeyStr,
+	}
+	if reply.Challenge, err = shared.NewChallenge(); err != nil {
+		return reply, err
+	}
+	session := shared.HandshakeSession{
+		Version:           shared.ProtocolVersion,
+		GenesisHash:       e.Settings.GenesisBlockHash,
+		DialerKey:         args.PubKey,
+		DialerIPPort:      args.IPPort,
+		DialerChallenge:   args.Challenge,
+		AnswererKey:       e.PubKeyStr,
+		AnswererIPPort:    e.MinerIPPort,
+		AnswererChallenge: reply.Challenge,
+	}
+	if !e.challenges.add(session, time.Now()) {
+		return reply, shared.HandshakeError("too many handshakes")
+	}
+	return reply, nil
+}
+
+// Check the dialing miner's signature of the session opened by our Hello
+// reply, and only then sign it back
+// Can return the following errors:
+// - HandshakeError
+func (e *Engine) Authenticate(args shared.ConnectMinerArgs) (session shared.HandshakeSession, reply shared.ConnectMinerReply, err error) {
+	session, ok := e.challenges.take(args.Challenge, time.Now())
+	if !ok {
+		return session, reply, shared.HandshakeError("no pending challenge")
+	}
+	if !shared.VerifyHandshake(session, shared.HandshakeDialer, args.Sig) {
+		return session, reply, shared.HandshakeError("bad signature of the session")
+	}
+
+	reply.PubKey = e.PubKeyStr
+	reply.Sig, err = shared.SignHandshake(e.PrivKey, session, shared.HandshakeAnswerer)
+	return session, reply, err
+}
+
+// Run the handshake as the dialing miner with the miner at ipPort, over
+// peer, finishing with method: Connect to be kept as its neighbour, or
+// Authenticate to check its key only. If pubKey is not empty, the peer
+// must own that key.
+// Return the peer's public key
+// Can return the following errors:
+// - HandshakeError
+// - errors of the calls
+func (e *Engine) handshake(peer Peer, ipPort string, method string, pubKey string) (peerKey string, err error) {
+	args := shared.HelloArgs{
+		Version:     shared.ProtocolVersion,
+		GenesisHash: e.Settings.GenesisBlockHash,
+		PubKey:      e.PubKeyStr,
+		IPPort:      e.MinerIPPort,
+	}
+	if args.Challenge, err = shared.NewChallenge(); err != nil {
+		return "", err
+	}
+	var hello shared.HelloReply
+	if err = callPeer(peer, "MinerMinerRPC.Hello", args, &hello); err != nil {
+		return "", err
+	}
+	if err = e.checkNetwork(hello.Version, hello.GenesisHash); err != nil {
+		return "", err
+	}
+	if pubKey != "" && hello.PubKey != pubKey {
+		return "", shared.HandshakeError("unexpected miner key")
+	}
+
+	session := shared.HandshakeSession{
+		Version:           shared.ProtocolVersion,
+		GenesisHash:       e.Settings.GenesisBlockHash,
+		DialerKey:         e.PubKeyStr,
+		DialerIPPort:      e.MinerIPPort,
+		DialerChallenge:   args.Challenge,
+		AnswererKey:       hello.PubKey,
+		AnswererIPPort:    ipPort,
+		AnswererChallenge: hello.Challenge,
+	}
+	connectArgs := shared.ConnectMinerArgs{Challenge: hello.Challenge}
+	if connectArgs.Sig, err = shared.SignHandshake(e.PrivKey, session, shared.HandshakeDialer); err != nil {
+		return "", err
+	}
+	var reply shared.ConnectMinerReply
+	if err = callPeer(peer, method, connectArgs, &reply); err != nil {
+		return "", err
+	}
+	if reply.PubKey != hello.PubKey || !shared.VerifyHandshake(session, shared.HandshakeAnswerer, reply.Sig) {
+		return "", shared.HandshakeError("bad signature of the session")
+	}
+	return hello.PubKey, nil
+}
+
+// Pair with a dialing miner: check its signature of the session, then dial
+// back the address it signed and check the miner listening there owns the
+// same key, so no other address is kept as a neighbour.
+// Can return the following errors:
+// - HandshakeError
+// - DisconnectedError
+func (e *Engine) AcceptPeer(args shared.ConnectMinerArgs) (reply shared.ConnectMinerReply, err error) {
+	session, reply, err := e.Authenticate(args)
+	if err != nil {
+		return reply, err
+	}
+
+	peer, err := e.Transport.Dial(session.DialerIPPort)
+	if err != nil {
+		return reply, shared.DisconnectedError(session.DialerIPPort)
+	}
+	if _, err = e.handshake(peer, session.DialerIPPort, "MinerMinerRPC.Authenticate", session.DialerKey); err != nil {
+		peer.Close()
+		return reply, err
+	}
+
+	e.Transport.AddNeighbour(session.DialerKey, peer)
+	return reply, nil
+}
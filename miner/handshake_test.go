@@ -0,0 +1,152 @@
+package miner
+
+import (
+	"../shared"
+	"os"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	a, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(a.DataDir)
+	b, bIPPort := newTestEngine(t, testSettings)
+	defer os.RemoveAll(b.DataDir)
+
+	pubKey, err := a.ConnectPeer(bIPPort)
+	if err != nil || pubKey != b.PubKeyStr {
+		t.Fatalf("connect returned [%s] [%v]", pubKey, err)
+	}
+	if _, connected := b.Transport.Neighbours()[a.PubKeyStr]; !connected {
+		t.Errorf("dialing miner not added as a neighbour")
+	}
+
+	// Another network
+	otherSettings := testSettings
+	otherSettings.GenesisBlockHash = "00000000000000000000000000000000"
+	c, _ := newTestEngine(t, otherSettings)
+	defer os.RemoveAll(c.DataDir)
+	if _, err := c.ConnectPeer(bIPPort); err == nil {
+		t.Errorf("miner of another network paired")
+	}
+
+	// Posing as a without its key, and without a challenge
+	peer, err := c.Transport.Dial(bIPPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	var reply shared.ConnectMinerReply
+	if err := peer.Call("MinerMinerRPC.Connect", shared.ConnectMinerArgs{}, &reply); err == nil {
+		t.Errorf("unauthenticated connect accepted")
+	}
+
+	hello := shared.HelloArgs{Version: shared.ProtocolVersion, GenesisHash: testSettings.GenesisBlockHash, PubKey: a.PubKeyStr, IPPort: c.MinerIPPort}
+	hello.Challenge, _ = shared.NewChallenge()
+	var helloReply shared.HelloReply
+	if err := peer.Call("MinerMinerRPC.Hello", hello, &helloReply); err != nil {
+		t.Fatal(err)
+	}
+	// Signed with c's key
+	session := shared.HandshakeSession{
+		Version:           shared.ProtocolVersion,
+		GenesisHash:       testSettings.GenesisBlockHash,
+		DialerKey:         a.PubKeyStr,
+		DialerIPPort:      c.MinerIPPort,
+		DialerChallenge:   hello.Challenge,
+		AnswererKey:       b.PubKeyStr,
+		AnswererIPPort:    bIPPort,
+		AnswererChallenge: helloReply.Challenge,
+	}
+	forged := shared.ConnectMinerArgs{Challenge: helloReply.Challenge}
+	forged.Sig, _ = shared.SignHandshake(c.PrivKey, session, shared.HandshakeDialer)
+	if err := peer.Call("MinerMinerRPC.Connect", forged, &reply); err == nil {
+		t.Errorf("session signed with another key accepted")
+	}
+
+	hello.Version++
+	if err := peer.Call("MinerMinerRPC.Hello", hello, &helloReply); err == nil {
+		t.Errorf("other protocol version accepted")
+	}
+}
+
+// m poses as b to c, getting b to sign in a handshake of its own with
+// c's challenge: b's signature covers that session only, so c refuses it
+func TestHandshakeRelay(t *testing.T) {
+	b, bIPPort := newTestEngine(t, testSettings)
+	defer os.RemoveAll(b.DataDir)
+	c, cIPPort := newTestEngine(t, testSettings)
+	defer os.RemoveAll(c.DataDir)
+	m, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(m.DataDir)
+
+	toC, err := m.Transport.Dial(cIPPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toC.Close()
+	helloC := shared.HelloArgs{Version: shared.ProtocolVersion, GenesisHash: testSettings.GenesisBlockHash, PubKey: b.PubKeyStr, IPPort: bIPPort}
+	helloC.Challenge, _ = shared.NewChallenge()
+	var replyC shared.HelloReply
+	if err := toC.Call("MinerMinerRPC.Hello", helloC, &replyC); err != nil {
+		t.Fatal(err)
+	}
+
+	// m's own handshake with b, with c's challenge as m's challenge
+	toB, err := m.Transport.Dial(bIPPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toB.Close()
+	helloB := shared.HelloArgs{Version: shared.ProtocolVersion, GenesisHash: testSettings.GenesisBlockHash, PubKey: m.PubKeyStr, IPPort: m.MinerIPPort, Challenge: replyC.Challenge}
+	var replyB shared.HelloReply
+	if err := toB.Call("MinerMinerRPC.Hello", helloB, &replyB); err != nil {
+		t.Fatal(err)
+	}
+	sessionB := shared.HandshakeSession{
+		Version:           shared.ProtocolVersion,
+		GenesisHash:       testSettings.GenesisBlockHash,
+		DialerKey:         m.PubKeyStr,
+		DialerIPPort:      m.MinerIPPort,
+		DialerChallenge:   replyC.Challenge,
+		AnswererKey:       b.PubKeyStr,
+		AnswererIPPort:    bIPPort,
+		AnswererChallenge: replyB.Challenge,
+	}
+	argsB := shared.ConnectMinerArgs{Challenge: replyB.Challenge}
+	argsB.Sig, _ = shared.SignHandshake(m.PrivKey, sessionB, shared.HandshakeDialer)
+	var signedByB shared.ConnectMinerReply
+	if err := toB.Call("MinerMinerRPC.Authenticate", argsB, &signedByB); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply shared.ConnectMinerReply
+	relayed := shared.ConnectMinerArgs{Challenge: replyC.Challenge, Sig: signedByB.Sig}
+	if err := toC.Call("MinerMinerRPC.Connect", relayed, &reply); err == nil {
+		t.Errorf("relayed signature accepted")
+	}
+	if _, connected := c.Transport.Neighbours()[b.PubKeyStr]; connected {
+		t.Errorf("m kept as neighbour b")
+	}
+}
+
+// A key that is not an ECDSA public key is refused, without crashing the miner
+func TestHandshakeMalformedKey(t *testing.T) {
+	a, aIPPort := newTestEngine(t, testSettings)
+	defer os.RemoveAll(a.DataDir)
+
+	peer, err := a.Transport.Dial(aIPPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	hello := shared.HelloArgs{Version: shared.ProtocolVersion, GenesisHash: testSettings.GenesisBlockHash, PubKey: "00", IPPort: "127.0.0.1:1"}
+	hello.Challenge, _ = shared.NewChallenge()
+	var reply shared.HelloReply
+	if err := peer.Call("MinerMinerRPC.Hello", hello, &reply); err == nil {
+		t.Errorf("malformed key accepted")
+	}
+
+	if _, err := shared.DecodePubKey("00"); err == nil {
+		t.Errorf("malformed key decoded")
+	}
+}
@@ -0,0 +1,191 @@
+package miner
+
+import (
+	"../shared"
+	"sync"
+	"time"
+)
+
+// How long a hash stays in a seen-set
+const inventoryTTL = 10 * time.Minute
+
+// Hashes of blocks and ops announced by or to a miner, see AnnounceInv
+type InvArgs struct {
+	// Public key of the announcing miner, not authenticated, see fetchInv
+	From   string
+	Blocks []string
+	Ops    []string
+}
+
+// Set of hashes, each forgotten inventoryTTL after it was added
+type seenSet struct {
+	entries   map[string]time.Time
+	nextPrune time.Time
+}
+
+func newSeenSet() *seenSet {
+	return &seenSet{entries: make(map[string]time.Time), nextPrune: time.Now().Add(inventoryTTL)}
+}
+
+// Add hash to the set, return false if it is in the set already
+func (s *seenSet) add(hash string, now time.Time) bool {
+	if now.After(s.nextPrune) {
+		for h, expiry := range s.entries {
+			if now.After(expiry) {
+				delete(s.entries, h)
+			}
+		}
+		s.nextPrune = now.Add(inventoryTTL)
+	}
+
+	if expiry, seen := s.entries[hash]; seen && !now.After(expiry) {
+		return false
+	}
+	s.entries[hash] = now.Add(inventoryTTL)
+	return true
+}
+
+func (s *seenSet) remove(hash string) {
+	delete(s.entries, hash)
+}
+
+// Which block and op hashes the miner and each of its neighbours have seen.
+// A hash is announced to a neighbour at most once, and fetched from one
+// neighbour at a time.
+type inventory struct {
+	lock sync.Mutex
+
+	// Hashes fetched or being fetched from a neighbour
+	seen *seenSet
+
+	// Hashes each neighbour announced or was announced
+	// Key: neighbour's public key
+	peers map[string]*seenSet
+}
+
+func newInventory() *inventory {
+	return &inventory{seen: newSeenSet(), peers: make(map[string]*seenSet)}
+}
+
+// Record that the neighbour has hash, return false if it was known to have it
+func (inv *inventory) addPeer(peer string, hash string) bool {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	known, ok := inv.peers[peer]
+	if !ok {
+		known = newSeenSet()
+		inv.peers[peer] = known
+	}
+	return known.add(hash, time.Now())
+}
+
+// Record that hash is being fetched, return false if it was seen already
+func (inv *inventory) add(hash string) bool {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	return inv.seen.add(hash, time.Now())
+}
+
+// Forget hashes that could not be fetched, so another neighbour's
+// announcement is fetched
+func (inv *inventory) remove(hashes []string) {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	for _, hash := range hashes {
+		inv.seen.remove(hash)
+	}
+}
+
+// Forget what a disconnected neighbour has
+func (inv *inventory) removePeer(peer string) {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	delete(inv.peers, peer)
+}
+
+// Announcements waiting to be fetched, one worker per announcer, so the
+// announcer's call returns right away and a slow fetch only delays the
+// announcer's own announcements
+type inbound struct {
+	lock sync.Mutex
+
+	// Key: announcer's public key
+	queues map[string]chan InvArgs
+}
+
+func newInbound() *inbound {
+	return &inbound{queues: make(map[string]chan InvArgs)}
+}
+
+// Queue an announcement of args.From. created is true if the queue is new
+// and needs a worker. Return false if the queue is full.
+func (in *inbound) push(args InvArgs) (q chan InvArgs, created bool, ok bool) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	q, exists := in.queues[args.From]
+	if !exists {
+		q = make(chan InvArgs, peerQueueSize)
+		in.queues[args.From] = q
+	}
+	select {
+	case q <- args:
+		return q, !exists, true
+	default:
+		return q, false, false
+	}
+}
+
+// Return the next announcement in the queue of from, or remove the queue
+// if it is empty: its worker stops
+func (in *inbound) next(from string, q chan InvArgs) (args InvArgs, ok bool) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	select {
+	case args = <-q:
+		return args, true
+	default:
+		delete(in.queues, from)
+		return args, false
+	}
+}
+
+// Queue the announcement of a neighbour for fetchInv, without waiting for
+// the fetch. Announcements of a neighbour are fetched in order; one that
+// finds the queue full is dropped, its hashes are not marked seen.
+// Can return the following errors:
+// - UnknownPeerError
+func (e *Engine) receiveInv(args InvArgs) error {
+	// Only neighbours get a worker
+	if _, connected := e.Transport.Neighbours()[args.From]; !connected {
+		return shared.UnknownPeerError(args.From)
+	}
+
+	q, created, ok := e.inbound.push(args)
+	if created {
+		go e.fetchInvQueue(args.From, q)
+	}
+	if !ok {
+		Log.Error("Announcements of miner [%s] not keeping up, dropping one", args.From)
+	}
+	return nil
+}
+
+// Fetch the queued announcements of a neighbour one after another, until
+// the queue is empty
+func (e *Engine) fetchInvQueue(from string, q chan InvArgs) {
+	for {
+		args, ok := e.inbound.next(from, q)
+		if !ok {
+			return
+		}
+		if err := e.fetchInv(args); err != nil {
+			Log.Error("Unable to fetch inventory from miner [%s], err: %s", from, err.Error())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package miner
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// A neighbour fetches announced blocks and ops it has not seen, once
+func TestInventoryGossip(t *testing.T) {
+	settings := testSettings
+	settings.PoWAlgorithm = PoWDev
+	a := newTestEngineWithInk(t, settings, 3)
+	defer os.RemoveAll(a.DataDir)
+	b := newTestEngineWithInk(t, settings, 0)
+	defer os.RemoveAll(b.DataDir)
+	a.initialized, b.initialized = true, true
+
+	for _, pair := range [][2]*Engine{{a, b}, {b, a}} {
+		peer, err := pair[0].Transport.Dial(pair[1].MinerIPPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pair[0].Transport.AddNeighbour(pair[1].PubKeyStr, peer)
+	}
+
+	// Announcements are sent in the background
+	eventually := func(cond func() bool) bool {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if cond() {
+				return true
+			}
+		}
+		return false
+	}
+
+	chain := a.GetLongestChain()
+	for _, block := range chain {
+		a.FloodMinerNetworkBlock(block)
+	}
+	for _, block := range chain {
+		if !eventually(func() bool { return b.HasBlock(block.Hash()) }) {
+			t.Fatalf("announced block [%s] not fetched", block.Hash())
+		}
+	}
+
+	op := testOp(t, a, 100, 0)
+	if err := a.DisseminateOp(op); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { _, queued := b.GetQueuedOp(op.HashToString()); return queued }) {
+		t.Fatalf("announced op not fetched")
+	}
+
+	// Seen by b already, announcing it again fetches nothing
+	if blocks, ops := b.missingInv(InvArgs{From: a.PubKeyStr, Blocks: []string{chain[0].Hash()}, Ops: []string{op.HashToString()}}); len(blocks) != 0 || len(ops) != 0 {
+		t.Errorf("seen hashes requested again, [%d] blocks [%d] ops", len(blocks), len(ops))
+	}
+}
+
+func TestSeenSetExpiry(t *testing.T) {
+	s := newSeenSet()
+	now := time.Now()
+	if !s.add("a", now) || s.add("a", now.Add(time.Second)) {
+		t.Fatalf("hash should be added once")
+	}
+	if !s.add("a", now.Add(inventoryTTL+time.Second)) {
+		t.Errorf("hash should be forgotten after inventoryTTL")
+	}
+	if !s.add("b", now.Add(3*inventoryTTL)) || len(s.entries) != 1 {
+		t.Errorf("expired hashes should be pruned, [%d] left", len(s.entries))
+	}
+}
+
+// Announced hashes the announcer doesn't send are forgotten, so another
+// neighbour's announcement of them is fetched, and the announcer is not
+// recorded as having them
+func TestInventoryNotSentForgotten(t *testing.T) {
+	settings := testSettings
+	settings.PoWAlgorithm = PoWDev
+	a := newTestEngineWithInk(t, settings, 3)
+	defer os.RemoveAll(a.DataDir)
+	b := newTestEngineWithInk(t, settings, 0)
+	defer os.RemoveAll(b.DataDir)
+	a.initialized, b.initialized = true, true
+
+	peer, err := b.Transport.Dial(a.MinerIPPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Transport.AddNeighbour(a.PubKeyStr, peer)
+
+	// Neither is known to a
+	op := testOp(t, a, 100, 0)
+	block := NoOpBlock{Version: settings.BlockVersion, PrevHash: a.LongestLeafHash(), PubKeyMiner: a.PubKeyStr, Timestamp: BlockTimestamp(time.Now()) + 10}
+	args := InvArgs{From: a.PubKeyStr, Blocks: []string{block.Hash()}, Ops: []string{op.HashToString()}}
+	if err := b.fetchInv(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if blocks, ops := b.missingInv(args); len(blocks) != 1 || len(ops) != 1 {
+		t.Errorf("hashes not sent stay seen, [%d] blocks [%d] ops to fetch", len(blocks), len(ops))
+	}
+	if !b.inv.addPeer(a.PubKeyStr, op.HashToString()) || !b.inv.addPeer(a.PubKeyStr, block.Hash()) {
+		t.Errorf("announcer recorded as having hashes it didn't send")
+	}
+}
+
+// AnnounceInv returns before the announced hashes are fetched: a neighbour
+// that is slow to send them doesn't hold up its announcements
+func TestAnnounceInvReturnsBeforeFetch(t *testing.T) {
+	e, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(e.DataDir)
+	e.initialized = true
+
+	hung := newStubPeer(false)
+	defer hung.Close()
+	e.Transport.AddNeighbour("hung", hung)
+	mm := NewMinerMinerRPC(e)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		var reply int
+		if err := mm.AnnounceInv(InvArgs{From: "hung", Ops: []string{fmt.Sprint(i)}}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("announcements held back for [%s]", elapsed)
+	}
+
+	var reply int
+	if err := mm.AnnounceInv(InvArgs{From: "stranger", Ops: []string{"0"}}, &reply); err == nil {
+		t.Errorf("announcement of a miner that is not a neighbour queued")
+	}
+}
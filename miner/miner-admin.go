@@ -0,0 +1,145 @@
+package miner
+
+import (
+	"../shared"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// How old a signed admin call may be, the accepted calls are remembered
+// for that long to refuse replaying them
+const adminCallMaxAge = 30 * time.Second
+
+// Admin facing rpc service, delegating to an Engine.
+// Serve it on localhost only: every call must be signed with the miner key,
+// see shared.SignAdminCall.
+type MinerAdminRPC struct {
+	e *Engine
+
+	lock sync.Mutex
+
+	// Calls accepted, until they are too old to be accepted again
+	// Key: hex of the call's AdminCallHash
+	// Val: time the call expires
+	accepted map[string]time.Time
+}
+
+func NewMinerAdminRPC(e *Engine) *MinerAdminRPC {
+	return &MinerAdminRPC{e: e, accepted: make(map[string]time.Time)}
+}
+
+// Return an error unless args is a recent call to method signed with the
+// miner key, that was not accepted before
+func (ma *MinerAdminRPC) authorize(method string, args shared.AdminArgs) error {
+	signedAt := time.Unix(0, args.Timestamp*int64(time.Millisecond))
+	now := time.Now()
+	age := now.Sub(signedAt)
+	if age > adminCallMaxAge || age < -adminCallMaxAge {
+		return shared.AdminAuthError(method)
+	}
+
+	hash := shared.AdminCallHash(method, args.Timestamp, args.Nonce, args.Peer)
+	if args.R == nil || args.S == nil || !ecdsa.Verify(&ma.e.PrivKey.PublicKey, hash, args.R, args.S) {
+		return shared.AdminAuthError(method)
+	}
+
+	ma.lock.Lock()
+	defer ma.lock.Unlock()
+
+	for h, expiry := range ma.accepted {
+		if now.After(expiry) {
+			delete(ma.accepted, h)
+		}
+	}
+	// Keyed by what is signed, not by the signature, which can be altered
+	// and still verify
+	key := hex.EncodeToString(hash)
+	if _, replayed := ma.accepted[key]; replayed {
+		return shared.AdminAuthError(method)
+	}
+	ma.accepted[key] = signedAt.Add(adminCallMaxAge)
+	return nil
+}
+
+func (ma *MinerAdminRPC) PauseMining(args shared.AdminArgs, reply *bool) (err error) {
+	if err = ma.authorize("PauseMining", args); err != nil {
+		return
+	}
+
+	ma.e.PauseMining()
+	*reply = true
+	return
+}
+
+func (ma *MinerAdminRPC) ResumeMining(args shared.AdminArgs, reply *bool) (err error) {
+	if err = ma.authorize("ResumeMining", args); err != nil {
+		return
+	}
+
+	ma.e.ResumeMining()
+	*reply = true
+	return
+}
+
+// Return the tip, height, hash rate estimate and queue sizes
+func (ma *MinerAdminRPC) GetStatus(args shared.AdminArgs, reply *shared.MinerStatus) (err error) {
+	if err = ma.authorize("GetStatus", args); err != nil {
+		return
+	}
+
+	*reply = ma.e.GetStatus()
+	return
+}
+
+// Return the ops in opQueue
+func (ma *MinerAdminRPC) GetOpQueue(args shared.AdminArgs, reply *[]shared.OpInfo) (err error) {
+	if err = ma.authorize("GetOpQueue", args); err != nil {
+		return
+	}
+
+	*reply = ma.e.GetQueuedOps()
+	return
+}
+
+// Return the blocks waiting for their parent
+func (ma *MinerAdminRPC) GetNoParentBlocks(args shared.AdminArgs, reply *[]shared.BlockInfo) (err error) {
+	if err = ma.authorize("GetNoParentBlocks", args); err != nil {
+		return
+	}
+
+	*reply = ma.e.GetNoParentBlocks()
+	return
+}
+
+// Return the public keys of the active neighbours
+func (ma *MinerAdminRPC) GetNeighbours(args shared.AdminArgs, reply *[]string) (err error) {
+	if err = ma.authorize("GetNeighbours", args); err != nil {
+		return
+	}
+
+	*reply = ma.e.GetNeighbours()
+	return
+}
+
+// Connect to the miner at args.Peer (IP:Port), reply its public key
+func (ma *MinerAdminRPC) ConnectPeer(args shared.AdminArgs, reply *string) (err error) {
+	if err = ma.authorize("ConnectPeer", args); err != nil {
+		return
+	}
+
+	*reply, err = ma.e.ConnectPeer(args.Peer)
+	return
+}
+
+// Disconnect from the neighbour with public key args.Peer
+func (ma *MinerAdminRPC) DisconnectPeer(args shared.AdminArgs, reply *bool) (err error) {
+	if err = ma.authorize("DisconnectPeer", args); err != nil {
+		return
+	}
+
+	err = ma.e.DisconnectPeer(args.Peer)
+	*reply = err == nil
+	return
+}
@@ -0,0 +1,84 @@
+package miner
+
+import (
+	"../shared"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"testing"
+)
+
+func TestMinerAdminRPC(t *testing.T) {
+	e, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(e.DataDir)
+	other, otherIPPort := newTestEngine(t, testSettings)
+	defer os.RemoveAll(other.DataDir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ServeRPC(listener, NewMinerAdminRPC(e)); err != nil {
+		t.Fatal(err)
+	}
+	client, err := rpc.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	call := func(privKey *ecdsa.PrivateKey, method, peer string, reply interface{}) error {
+		args, err := shared.SignAdminCall(privKey, method, peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.Call("MinerAdminRPC."+method, args, reply)
+	}
+
+	// Only the miner key is accepted
+	stranger, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var status shared.MinerStatus
+	if err := call(stranger, "GetStatus", "", &status); err == nil {
+		t.Errorf("call signed by another key accepted")
+	}
+	args, _ := shared.SignAdminCall(e.PrivKey, "GetStatus", "")
+	var ok bool
+	if err := client.Call("MinerAdminRPC.PauseMining", args, &ok); err == nil {
+		t.Errorf("call signed for another method accepted")
+	}
+	if err := client.Call("MinerAdminRPC.GetStatus", args, &status); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("MinerAdminRPC.GetStatus", args, &status); err == nil {
+		t.Errorf("replayed call accepted")
+	}
+
+	var paused bool
+	if err := call(e.PrivKey, "PauseMining", "", &paused); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(e.PrivKey, "GetStatus", "", &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.MiningPaused || status.PubKey != e.PubKeyStr || status.TipHash != testSettings.GenesisBlockHash {
+		t.Errorf("unexpected status [%+v]", status)
+	}
+
+	var pubKey string
+	if err := call(e.PrivKey, "ConnectPeer", otherIPPort, &pubKey); err != nil || pubKey != other.PubKeyStr {
+		t.Fatalf("connected to [%s] [%v]", pubKey, err)
+	}
+	var neighbours []string
+	if err := call(e.PrivKey, "GetNeighbours", "", &neighbours); err != nil || len(neighbours) != 1 || neighbours[0] != other.PubKeyStr {
+		t.Errorf("neighbours [%v] [%v]", neighbours, err)
+	}
+	if err := call(e.PrivKey, "DisconnectPeer", other.PubKeyStr, &ok); err != nil || e.Transport.NumNeighbours() != 0 {
+		t.Errorf("not disconnected [%v]", err)
+	}
+	if err := call(e.PrivKey, "DisconnectPeer", other.PubKeyStr, &ok); err == nil {
+		t.Errorf("disconnected from a miner that is not a neighbour")
+	}
+}
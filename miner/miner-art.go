@@ -5,44 +5,49 @@ import (
 	"crypto/ecdsa"
 )
 
-type MinerArtRPC int
+// Art node facing rpc service, delegating to an Engine
+type MinerArtRPC struct {
+	e *Engine
+}
 
-var (
-	artnodeRegHash []byte
-	localIPPort    string
-)
+var artnodeRegHash []byte
 
-func (ma MinerArtRPC) OpenCanvas(args shared.OpenArgs, reply *shared.CanvasSettings) (err error) {
+func NewMinerArtRPC(e *Engine) *MinerArtRPC {
+	return &MinerArtRPC{e: e}
+}
+
+func (ma *MinerArtRPC) OpenCanvas(args shared.OpenArgs, reply *shared.CanvasSettings) (err error) {
 	Log.Trace(args)
-	Log.Trace(&(PrivKey.PublicKey), artnodeRegHash, args.R, args.S)
+	Log.Trace(&(ma.e.PrivKey.PublicKey), artnodeRegHash, args.R, args.S)
 
-	validKey := ecdsa.Verify(&(PrivKey.PublicKey), artnodeRegHash, args.R, args.S)
+	validKey := ecdsa.Verify(&(ma.e.PrivKey.PublicKey), artnodeRegHash, args.R, args.S)
 	if !validKey {
-		return shared.DisconnectedError(localIPPort)
+		return shared.DisconnectedError(ma.e.ArtIPPort)
 	}
 
-	*reply = NetSettings.CanvasSettings
+	*reply = ma.e.Settings.CanvasSettings
 
 	return
 }
 
-func (ma MinerArtRPC) CloseCanvas(args int, reply *uint32) (err error) {
+func (ma *MinerArtRPC) CloseCanvas(args int, reply *uint32) (err error) {
 	Log.Trace(args)
 	return
 }
 
-func (ma MinerArtRPC) AddShape(args shared.AddArgs, reply *shared.AddReply) (err error) {
+func (ma *MinerArtRPC) AddShape(args shared.AddArgs, reply *shared.AddReply) (err error) {
 	Log.Trace(args)
 
 	shape := Shape{
-		Owner:     PubKeyStr,
+		Owner:     ma.e.PubKeyStr,
 		ShapeType: args.ShapeType,
 		Svg:       args.ShapeSvgString,
 		Fill:      args.Fill,
 		Stroke:    args.Stroke,
+		Version:   ma.e.Settings.BlockVersion,
 	}
 
-	shapeHash, blockHash, inkRemaining, err := AddShapeToBlockChain(args.ValidateNum, shape)
+	shapeHash, blockHash, inkRemaining, err := ma.e.AddShapeToBlockChain(args.ValidateNum, shape, args.Fee)
 	if err != nil {
 		return
 	}
@@ -52,10 +57,10 @@ func (ma MinerArtRPC) AddShape(args shared.AddArgs, reply *shared.AddReply) (err
 	return
 }
 
-func (ma MinerArtRPC) RmShape(args shared.RmArgs, reply *shared.RmReply) (err error) {
+func (ma *MinerArtRPC) RmShape(args shared.RmArgs, reply *shared.RmReply) (err error) {
 	Log.Trace(args)
 
-	inkRemaining, err := DeleteShapeFromBlockChain(args.ValidateNum, args.ShapeHash)
+	inkRemaining, err := ma.e.DeleteShapeFromBlockChain(args.ValidateNum, args.ShapeHash)
 	if err != nil {
 		return
 	}
@@ -65,7 +70,7 @@ func (ma MinerArtRPC) RmShape(args shared.RmArgs, reply *shared.RmReply) (err er
 	return
 }
 
-func (ma MinerArtRPC) Get(args shared.GetArgs, reply *shared.GetReply) (err error) {
+func (ma *MinerArtRPC) Get(args shared.GetArgs, reply *shared.GetReply) (err error) {
 	Log.Trace(args)
 
 	var (
@@ -76,15 +81,15 @@ func (ma MinerArtRPC) Get(args shared.GetArgs, reply *shared.GetReply) (err erro
 
 	switch args.Type {
 	case shared.INK:
-		intReply = GetInk(PubKeyStr)
+		intReply = ma.e.GetInk(ma.e.PubKeyStr)
 	case shared.SVG: // given shapeHash
-		strReply, err = GetSVGFields(args.Hash)
+		strReply, err = ma.e.GetSVGFields(args.Hash)
 	case shared.SHAPES:
-		strArrReply, err = GetShapes(args.Hash)
+		strArrReply, err = ma.e.GetShapes(args.Hash)
 	case shared.GEN:
-		strReply, err = GetGenesisBlockHash()
+		strReply, err = ma.e.GetGenesisBlockHash()
 	case shared.CHILDREN:
-		strArrReply, err = GetChildren(args.Hash)
+		strArrReply, err = ma.e.GetChildren(args.Hash)
 	default:
 		Log.Error("Invalid Get TYPE %d", args.Type)
 	}
@@ -97,3 +102,63 @@ func (ma MinerArtRPC) Get(args shared.GetArgs, reply *shared.GetReply) (err erro
 
 	return
 }
+
+// Return the mature and pending ink of the art node's miner
+func (ma *MinerArtRPC) GetInkBalance(args int, reply *shared.InkBalance) (err error) {
+	Log.Trace(args)
+
+	*reply = ma.e.GetInkBalance(ma.e.PubKeyStr)
+	return
+}
+
+// ---------------------------------------------------------------------
+// Block explorer
+// ---------------------------------------------------------------------
+
+// Return a block's header and ops
+func (ma *MinerArtRPC) GetBlock(blockHash string, reply *shared.BlockInfo) (err error) {
+	Log.Trace(blockHash)
+
+	*reply, err = ma.e.GetBlockInfo(blockHash)
+	return
+}
+
+// Return an op with its containing block and confirmation count
+func (ma *MinerArtRPC) GetOp(opHash string, reply *shared.OpInfo) (err error) {
+	Log.Trace(opHash)
+
+	*reply, err = ma.e.GetOpInfo(opHash)
+	return
+}
+
+// Return the ink of every miner as of a block
+func (ma *MinerArtRPC) GetInkTable(blockHash string, reply *map[string]uint32) (err error) {
+	Log.Trace(blockHash)
+
+	*reply, err = ma.e.GetInkTable(blockHash)
+	return
+}
+
+// Return the block hashes of the longest chain, from Genesis to the leaf
+func (ma *MinerArtRPC) GetLongestChain(args int, reply *[]string) (err error) {
+	Log.Trace(args)
+
+	*reply = ma.e.GetLongestChainHashes()
+	return
+}
+
+// Return the fields a block's hash commits to
+func (ma *MinerArtRPC) GetBlockHeader(blockHash string, reply *shared.BlockHeader) (err error) {
+	Log.Trace(blockHash)
+
+	*reply, err = ma.e.GetBlockHeader(blockHash)
+	return
+}
+
+// Return the Merkle branch linking an op to its block's header
+func (ma *MinerArtRPC) GetOpProof(opHash string, reply *shared.OpProof) (err error) {
+	Log.Trace(opHash)
+
+	*reply, err = ma.e.GetOpProof(opHash)
+	return
+}
@@ -6,61 +6,49 @@ package miner
 
 import (
 	"../shared"
-	"net/rpc"
 )
 
-type MinerMinerRPC int
+// Miner facing rpc service, delegating to an Engine
+type MinerMinerRPC struct {
+	e *Engine
+}
 
-// Called by new miner to be connected
-func (mm MinerMinerRPC) Connect(newMiner shared.ConnectMinerArgs, myKey *string) (err error) {
-	*myKey, _ = shared.EncodePubKey(PrivKey.PublicKey)
-	conn, err := rpc.Dial("tcp", newMiner.IPPort)
-	if err != nil {
-		return
-	}
-	UpdateNeighbours(newMiner.EncodedPubKey, conn)
-	return nil
+func NewMinerMinerRPC(e *Engine) *MinerMinerRPC {
+	return &MinerMinerRPC{e: e}
 }
 
-// Retrieve a block with a given hash
-func (mm MinerMinerRPC) GetBlockFromHash(hash string, block *Block) (err error) {
-	Log.Debug("A miner is trying to retrieve block wtih hash [%s]", hash)
-	*block , err = GetBlock(hash)
+// Called by a new miner to start the handshake, see Engine.Hello
+func (mm *MinerMinerRPC) Hello(args shared.HelloArgs, reply *shared.HelloReply) (err error) {
+	*reply, err = mm.e.Hello(args)
 	return
 }
 
-// RPC call to periodically check up on miners and see if they are still active
-func (mm MinerMinerRPC) IsAlive(arg int, reply *bool) (err error) {
-	*reply = true
+// Called by a miner we dialed back to check its key, see Engine.Authenticate
+func (mm *MinerMinerRPC) Authenticate(args shared.ConnectMinerArgs, reply *shared.ConnectMinerReply) (err error) {
+	_, *reply, err = mm.e.Authenticate(args)
 	return
 }
 
-func RemoveInactiveMiner(key string) (err error) {
-	NeighbourLock.Lock()
-	defer NeighbourLock.Unlock()
-
-	conn, _ := ActiveNeighbours[key]
-	if conn != nil {
-		conn.Close()
-	}
-	delete(ActiveNeighbours, key)
-	NumNeighbours--
-	Log.Debug("Inactive miner removed\n Total connections [%v]", NumNeighbours)
+// Called by new miner to be connected, once it has signed the session of our Hello reply
+func (mm *MinerMinerRPC) Connect(newMiner shared.ConnectMinerArgs, reply *shared.ConnectMinerReply) (err error) {
+	*reply, err = mm.e.AcceptPeer(newMiner)
 	return
 }
 
-func UpdateNeighbours(key string, conn *rpc.Client) (err error) {
-	NeighbourLock.Lock()
-	defer NeighbourLock.Unlock()
-
-	if _, exists := ActiveNeighbours[key]; exists {
-		// if neighbour already exists, keep old connection and close the new one
-		conn.Close()
-		return
+// Retrieve a block with a given hash
+func (mm *MinerMinerRPC) GetBlockFromHash(hash string, reply *GeneralBlock) (err error) {
+	Log.Debug("A miner is trying to retrieve block wtih hash [%s]", hash)
+	block, err := mm.e.GetBlock(hash)
+	if err != nil {
+		return err
 	}
-	ActiveNeighbours[key] = conn
-	NumNeighbours++
-	Log.Debug("New neighbour -- Total connections [%v]", NumNeighbours)
+	*reply = ToGeneralBlock(block)
+	return nil
+}
+
+// RPC call to periodically check up on miners and see if they are still active
+func (mm *MinerMinerRPC) IsAlive(arg int, reply *bool) (err error) {
+	*reply = true
 	return
 }
 
@@ -68,53 +56,58 @@ func UpdateNeighbours(key string, conn *rpc.Client) (err error) {
 // Miner Receiving from miner network
 // ---------------------------------------------------------------------
 
-// Receive Op from other miners
-func (mm MinerMinerRPC) FloodOp(args Op, reply *int) (err error) {
-	DisseminateOp(args)
-	return nil
+// Receive block and op hashes from other miners, the ones not seen yet are
+// fetched in the background, see receiveInv
+func (mm *MinerMinerRPC) AnnounceInv(args InvArgs, reply *int) (err error) {
+	return mm.e.receiveInv(args)
 }
 
-// Receive OpBlock from other miners
-func (mm MinerMinerRPC) FloodOpBlock(args OpBlock, reply *int) (err error) {
-	DisseminateBlock(args)
+// Return the blocks with the given hashes, skipping the unknown ones
+func (mm *MinerMinerRPC) GetBlocks(hashes []string, reply *RawGenBlockchain) (err error) {
+	for _, hash := range hashes {
+		if block, err := mm.e.GetBlock(hash); err == nil {
+			*reply = append(*reply, ToGeneralBlock(block))
+		}
+	}
 	return nil
 }
 
-// Receive NoOpBlock from other miners
-func (mm MinerMinerRPC) FloodNoOpBlock(args NoOpBlock, reply *int) (err error) {
-	DisseminateBlock(args)
+// Return the queued ops with the given hashes, skipping the unknown ones
+func (mm *MinerMinerRPC) GetOps(hashes []string, reply *[]Op) (err error) {
+	for _, hash := range hashes {
+		if op, ok := mm.e.GetQueuedOp(hash); ok {
+			*reply = append(*reply, op)
+		}
+	}
 	return nil
 }
 
-// When a new miner joins the network, this provides the new miner latest block chain data
-func (mm MinerMinerRPC) GetChain(args int, reply *RawGenBlockchain) (err error) {
-	rawChain := GetLongestChain()
+// Receive Op from other miners, that push it instead of announcing it
+func (mm *MinerMinerRPC) FloodOp(args Op, reply *int) (err error) {
+	mm.e.DisseminateOp(args)
+	return nil
+}
 
-	processedChain := RawGenBlockchain{}
+// Receive OpBlock from other miners, that push it instead of announcing it
+func (mm *MinerMinerRPC) FloodOpBlock(args OpBlock, reply *int) (err error) {
+	mm.e.DisseminateBlock(args)
+	return nil
+}
 
-	for _, block := range rawChain {
-		genBlock := GeneralBlock{}
-		switch block.(type) {
-		case OpBlock:
-			genBlock = GeneralBlock{
-				PrevHash:    block.(OpBlock).PrevHash,
-				PubKeyMiner: block.(OpBlock).PubKeyMiner,
-				Nonce:       block.(OpBlock).Nonce,
-				Ops:         block.(OpBlock).Ops,
-			}
-		case NoOpBlock:
-			genBlock = GeneralBlock{
-				PrevHash:    block.(NoOpBlock).PrevHash,
-				PubKeyMiner: block.(NoOpBlock).PubKeyMiner,
-				Nonce:       block.(NoOpBlock).Nonce,
-				Ops:         []Op{},
-			}
-		}
+// Receive NoOpBlock from other miners, that push it instead of announcing it
+func (mm *MinerMinerRPC) FloodNoOpBlock(args NoOpBlock, reply *int) (err error) {
+	mm.e.DisseminateBlock(args)
+	return nil
+}
 
-		processedChain = append(processedChain, genBlock)
+// Return the headers of our longest chain after the fork point with the
+// caller's locator, see SyncWithNetwork
+func (mm *MinerMinerRPC) GetHeaders(args LocatorArgs, reply *[]shared.BlockHeader) (err error) {
+	max := args.Max
+	if max <= 0 || max > maxHeadersPerCall {
+		max = maxHeadersPerCall
 	}
-
-	*reply = processedChain
+	*reply = mm.e.HeadersAfter(args.Locator, max)
 	return nil
 }
 
@@ -122,148 +115,150 @@ func (mm MinerMinerRPC) GetChain(args int, reply *RawGenBlockchain) (err error)
 // Miner Sending to miner network
 // ---------------------------------------------------------------------
 
-// Flood miner network with Block
-func FloodMinerNetworkBlock(args Block) (err error) {
-	var reply int
-	for _, conn := range ActiveNeighbours {
-		switch args.(type) {
-		case OpBlock:
-			err = conn.Call("MinerMinerRPC.FloodOpBlock", args.(OpBlock), &reply)
-		case NoOpBlock:
-			err = conn.Call("MinerMinerRPC.FloodNoOpBlock", args.(NoOpBlock), &reply)
-		default:
-			Log.Error("bad type")
-		}
-
-		if err != nil {
-			Log.Error("rpc call err [%s]", err.Error())
-		}
-	}
+// Flood miner network with Block's hash
+func (e *Engine) FloodMinerNetworkBlock(args Block) (err error) {
+	e.announceInv([]string{args.Hash()}, nil)
 	return nil
 }
 
-// Flood miner network with Op
-func FloodMinerNetworkOp(args Op) (err error) {
-	var reply int
-	for _, conn := range ActiveNeighbours {
-		err := conn.Call("MinerMinerRPC.FloodOp", args, &reply)
-		if err != nil {
-			Log.Error("rpc call err [%s]", err.Error())
-		}
-	}
+// Flood miner network with Op's hash
+func (e *Engine) FloodMinerNetworkOp(args Op) (err error) {
+	e.announceInv(nil, []string{args.HashToString()})
 	return nil
 }
 
-// Return the valid, longest chain from neighbours
-// Each neighbour returns a raw block chain, need to compare
-// and produce our own longest, valid raw block chain.
-func GetNetworkBlockchain() RawBlockchain {
-	// Obtain raw block chain from each neighbour, store them in blockchains
-	var blockchains []RawBlockchain
-	for pubHash, conn := range ActiveNeighbours {
-		var reply RawGenBlockchain
-		var args int
-		err := conn.Call("MinerMinerRPC.GetChain", args, &reply)
-		if err != nil {
-			Log.Error("Unable to make an RPC call to miner [%s], err: %s ", pubHash, err.Error())
-		} else {
-			Log.Debug("Got a raw blockchain of length [%d] from neighbour", len(reply))
-
-			// convert genblocks in chain to blocks
-			rawChain := RawBlockchain{}
-			for _, genBlock := range reply {
-				if len(genBlock.Ops) == 0 {
-					noOpBlock := NoOpBlock{
-						PrevHash:    genBlock.PrevHash,
-						PubKeyMiner: genBlock.PubKeyMiner,
-						Nonce:       genBlock.Nonce,
-					}
-					rawChain = append(rawChain, noOpBlock)
-				} else {
-					opBlock := OpBlock{
-						PrevHash:    genBlock.PrevHash,
-						Ops:         genBlock.Ops,
-						PubKeyMiner: genBlock.PubKeyMiner,
-						Nonce:       genBlock.Nonce,
-					}
-					rawChain = append(rawChain, opBlock)
-				}
+// Announce block and op hashes to the neighbours not known to have them.
+// The announcements are queued, a slow neighbour does not hold up the others.
+func (e *Engine) announceInv(blocks []string, ops []string) {
+	for pubKey, conn := range e.Transport.Neighbours() {
+		args := InvArgs{From: e.PubKeyStr}
+		for _, hash := range blocks {
+			if e.inv.addPeer(pubKey, hash) {
+				args.Blocks = append(args.Blocks, hash)
+			}
+		}
+		for _, hash := range ops {
+			if e.inv.addPeer(pubKey, hash) {
+				args.Ops = append(args.Ops, hash)
 			}
-
-			// add chain to chain array
-			blockchains = append(blockchains, rawChain)
+		}
+		if len(args.Blocks) == 0 && len(args.Ops) == 0 {
+			continue
 		}
 
+		e.sendToPeer(pubKey, conn, "MinerMinerRPC.AnnounceInv", args)
 	}
-
-	return GetLongestChainInNetwork(blockchains)
 }
 
-// Returns the longest chain agreed by the majority of the blockchain copies
-func GetLongestChainInNetwork(chains []RawBlockchain) (longestChain RawBlockchain) {
-
-	/* Some local helpers */
-
-	type BlockHashCountTable map[string][]*RawBlockchain // hash -> chains with hash
+// Fetch the announced blocks and ops the miner has not seen yet from the
+// announcing neighbour, and disseminate them. args.From is not
+// authenticated: it only picks the connection the hashes are fetched from,
+// and the neighbour is only known to have what it sent on it.
+// Can return the following errors:
+// - UnknownPeerError
+// - PeerTimeoutError
+func (e *Engine) fetchInv(args InvArgs) (err error) {
+	blocks, ops := e.missingInv(args)
+	if len(blocks) == 0 && len(ops) == 0 {
+		return nil
+	}
 
-	getHashWithMaxCount := func(tbl BlockHashCountTable) (maxCount int, maxHash string) {
-		for hash, chains := range tbl {
-			if len(chains) > maxCount {
-				maxCount = len(chains)
-				maxHash = hash
+	// Forget the hashes the neighbour did not send, or sent invalid data
+	// for, so another neighbour's announcement is fetched
+	received := make(map[string]bool)
+	defer func() {
+		var missing []string
+		for _, hashes := range [][]string{blocks, ops} {
+			for _, hash := range hashes {
+				if !received[hash] {
+					missing = append(missing, hash)
+				}
 			}
 		}
-		return
+		e.inv.remove(missing)
+	}()
+
+	conn, connected := e.Transport.Neighbours()[args.From]
+	if !connected {
+		return shared.UnknownPeerError(args.From)
 	}
 
-	GethMaxLengthOfChains := func(chains []RawBlockchain) int {
-		maxLength := 0
-		for _, chain := range chains {
-			if len(chain) > maxLength {
-				maxLength = len(chain)
+	if len(ops) > 0 {
+		var reply []Op
+		if err = callPeer(conn, "MinerMinerRPC.GetOps", ops, &reply); err != nil {
+			Log.Error("rpc call err [%s]", err.Error())
+			return err
+		}
+		for _, op := range reply {
+			opHash := op.HashToString()
+			if !wanted(ops, opHash) || received[opHash] {
+				continue
+			}
+			// The neighbour has it, don't announce it back
+			e.inv.addPeer(args.From, opHash)
+			// An op with a bad signature has the hash of the valid one:
+			// let another neighbour's announcement be fetched
+			if err := e.DisseminateOp(op); err == nil {
+				received[opHash] = true
 			}
 		}
-		return maxLength
 	}
 
-	/* Implementation */
-
-	majority := len(chains) / 2
-
-	var maxCount int                          // max number of miners having the same block at the same index
-	var maxHash string                        // the hash agreed by the most miners at an index
-	var blockHashCountTbl BlockHashCountTable // hash -> chains with hash at an index
-
-	// Start from the highest index
-	// look for a block with majority at the index
-	// if no such block then decrease index and repeat
-	for i := GethMaxLengthOfChains(chains); i >= 0; i-- {
-		blockHashCountTbl = make(BlockHashCountTable)
-
-		// get the counts of owners for each block hash existing at the current index
-		for _, chain := range chains {
-			if len(chain) > i {
-				h := chain[i].Hash()
-				blockHashCountTbl[h] = append(blockHashCountTbl[h], &chain)
+	if len(blocks) > 0 {
+		var reply RawGenBlockchain
+		if err = callPeer(conn, "MinerMinerRPC.GetBlocks", blocks, &reply); err != nil {
+			Log.Error("rpc call err [%s]", err.Error())
+			return err
+		}
+		for _, genBlock := range reply {
+			block := genBlock.ToBlock()
+			blockHash := block.Hash()
+			if !wanted(blocks, blockHash) || received[blockHash] {
+				continue
+			}
+			e.inv.addPeer(args.From, blockHash)
+			// The block sent may not be the one announced, the same hash
+			// can stand for an invalid block, see checkDuplicateOps: let
+			// another neighbour's announcement be fetched. Orphans are
+			// skipped by missingInv anyway.
+			if err := e.disseminateBlockFrom(block, args.From); err == nil {
+				received[blockHash] = true
 			}
 		}
+	}
+	return nil
+}
 
-		maxCount, maxHash = getHashWithMaxCount(blockHashCountTbl)
+// Return the announced hashes not in the tree, the blocks waiting for their
+// parent, the op queue or the longest chain's op log, nor fetched already
+func (e *Engine) missingInv(args InvArgs) (blocks []string, ops []string) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
 
-		if maxCount > majority {
-			break
+	for _, hash := range args.Blocks {
+		_, inTree := e.treeTable[hash]
+		if !inTree && !e.orphans.has(hash) && e.inv.add(hash) {
+			blocks = append(blocks, hash)
 		}
-
-		maxHash = ""
 	}
 
-	if maxHash == "" {
-		// returns empty chain if no majority found
-		longestChain = RawBlockchain{}
-	} else {
-		// get one of the chains containing the latest block with the majority
-		longestChain = *(blockHashCountTbl[maxHash][0])
+	opLog := e.treeTable[e.longestLeafHash].OpLog
+	for _, hash := range args.Ops {
+		_, inQueue := e.opQueue[hash]
+		_, inLog := opLog.Get(hash)
+		if !inQueue && !inLog && e.inv.add(hash) {
+			ops = append(ops, hash)
+		}
 	}
+	return blocks, ops
+}
 
-	return
+// Return true if hash was requested, a neighbour can't push other data
+func wanted(hashes []string, hash string) bool {
+	for _, h := range hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,113 @@
+package miner
+
+import (
+	"../shared"
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Number of consecutive nonces a worker takes from the nonce space at a time
+	nonceRangeSize = 1 << 16
+
+	// Number of ranges covering every nonce of one extra nonce
+	nonceRangesPerExtraNonce = (1 << 32) / nonceRangeSize
+
+	// Number of hashes a worker computes between checks for cancellation
+	cancelCheckInterval = 1 << 10
+)
+
+// Find the nonce for the given block data, meeting difficulty
+// with the network's proof of work algorithm
+// Output same block with the nonce and extra nonce fields set
+// It returns nil once ctx is cancelled, when the block being mined is out-dated.
+func (e *Engine) FindNonce(ctx context.Context, block Block, difficulty uint8) Block {
+	// The Merkle root is computed once, the PoW only changes the nonces
+	header, found := e.pow.Seal(ctx, block.Header(), difficulty)
+	if !found {
+		return nil
+	}
+	return sealBlock(block, header.Nonce, header.ExtraNonce)
+}
+
+// Search nonces for header until powHash of it starts with difficulty
+// zero bits. The nonce space is split between GOMAXPROCS workers.
+// found is false if ctx is cancelled first.
+func sealWithWorkers(ctx context.Context, header shared.BlockHeader, difficulty uint8, powHash func(shared.BlockHeader) []byte) (sealed shared.BlockHeader, found bool) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	numWorkers := runtime.GOMAXPROCS(0)
+	// Each worker sends at most once, so none of them blocks
+	results := make(chan shared.BlockHeader, numWorkers)
+	var nextRange uint64
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			searchNonces(ctx, header, difficulty, powHash, &nextRange, results)
+		}()
+	}
+	// Stop the other workers before waiting for them
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	select {
+	case sealed = <-results:
+		return sealed, true
+	case <-ctx.Done():
+		return header, false
+	}
+}
+
+// Search the nonce ranges taken from nextRange, in order, until powHash
+// of header meets difficulty or ctx is cancelled.
+// Range r covers the nonces from (r % nonceRangesPerExtraNonce) * nonceRangeSize
+// with extra nonce r / nonceRangesPerExtraNonce, so the extra nonce
+// only moves on once every nonce was tried.
+func searchNonces(ctx context.Context, header shared.BlockHeader, difficulty uint8, powHash func(shared.BlockHeader) []byte, nextRange *uint64, results chan<- shared.BlockHeader) {
+	for {
+		r := atomic.AddUint64(nextRange, 1) - 1
+		header.ExtraNonce = uint32(r / nonceRangesPerExtraNonce)
+		start := uint32(r%nonceRangesPerExtraNonce) * nonceRangeSize
+
+		for i := uint32(0); i < nonceRangeSize; i++ {
+			if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+				return
+			}
+			header.Nonce = start + i
+			if shared.LeadingZeroBits(powHash(header)) >= int(difficulty) {
+				results <- header
+				return
+			}
+		}
+	}
+}
+
+// Return a copy of block with the nonces found for it
+func sealBlock(block Block, nonce, extraNonce uint32) Block {
+	switch b := block.(type) {
+	case OpBlock:
+		b.Nonce, b.ExtraNonce = nonce, extraNonce
+		return b
+	case NoOpBlock:
+		b.Nonce, b.ExtraNonce = nonce, extraNonce
+		return b
+	default:
+		Log.Error("unsupported Block type")
+		return nil
+	}
+}
+
+// Cancel the nonce search of the block being mined, it no longer
+// extends the longest leaf or leaves out queued ops
+// Precondition: e.lock is held for writing
+func (e *Engine) interruptMining() {
+	if e.cancelMining != nil {
+		e.cancelMining()
+	}
+}
@@ -0,0 +1,60 @@
+package miner
+
+import (
+	"../shared"
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFindNonce(t *testing.T) {
+	e := &Engine{pow: HashPrefixPoW{}}
+	block := NoOpBlock{Version: shared.BlockVersion2, PrevHash: "83218ac34c1834c26781fe4bde918ee4", Timestamp: 1}
+
+	found := e.FindNonce(context.Background(), block, 12)
+	if found == nil || !e.pow.Verify(found.Header(), 12) {
+		t.Fatalf("no valid nonce found")
+	}
+	if found.GetPrevHash() != block.PrevHash || found.GetTimestamp() != block.Timestamp {
+		t.Errorf("sealed block does not match the mined block")
+	}
+
+	// Out-dated before a nonce is found
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if e.FindNonce(ctx, block, 64) != nil {
+		t.Errorf("cancelled search returned a block")
+	}
+}
+
+// The other workers are stopped once one finds a nonce, instead of
+// searching on until each finds one
+func TestSealReturnsOnFirstNonce(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	// Only the first nonce meets the difficulty, the other workers would
+	// search on forever
+	powHash := func(header shared.BlockHeader) []byte {
+		if header.Nonce == 0 && header.ExtraNonce == 0 {
+			return make([]byte, 16)
+		}
+		time.Sleep(100 * time.Microsecond)
+		return []byte{0xff}
+	}
+
+	done := make(chan shared.BlockHeader)
+	go func() {
+		sealed, _ := sealWithWorkers(context.Background(), shared.BlockHeader{}, 8, powHash)
+		done <- sealed
+	}()
+
+	select {
+	case sealed := <-done:
+		if sealed.Nonce != 0 || sealed.ExtraNonce != 0 {
+			t.Errorf("unexpected nonce [%d] [%d]", sealed.Nonce, sealed.ExtraNonce)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("search did not return after the first nonce")
+	}
+}
@@ -0,0 +1,290 @@
+package miner
+
+import (
+	"../shared"
+	"sort"
+	"time"
+)
+
+const (
+	// Most blocks waiting for their parent
+	maxOrphans = 256
+
+	// Most orphans one neighbour may have in the pool
+	maxOrphansPerPeer = 64
+
+	// How long an orphan waits for its parent
+	orphanTTL = 10 * time.Minute
+
+	// How often the missing parents are fetched
+	orphanFetchInterval = 5 * time.Second
+)
+
+// A block whose parent is not in the tree
+type orphan struct {
+	block Block
+
+	// Public key of the neighbour that sent it, empty if unknown
+	peer string
+
+	expiry time.Time
+}
+
+// Blocks waiting for their parent, keyed by the missing parent
+// Precondition: guarded by e.lock
+type orphanPool struct {
+	// Key: block hash
+	blocks map[string]*orphan
+
+	// Hashes of the orphans waiting for each parent
+	// Key: parent hash
+	byParent map[string]map[string]bool
+
+	// Number of orphans each neighbour sent
+	// Key: neighbour's public key
+	perPeer map[string]int
+}
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		blocks:   make(map[string]*orphan),
+		byParent: make(map[string]map[string]bool),
+		perPeer:  make(map[string]int),
+	}
+}
+
+// Add block, sent by peer. The orphan closest to expiry makes room if
+// the pool is full. Return false if the block is refused: it is in the pool
+// already or the peer has maxOrphansPerPeer orphans in it.
+func (p *orphanPool) add(block Block, peer string, now time.Time) bool {
+	hash := block.Hash()
+	if _, exists := p.blocks[hash]; exists || p.perPeer[peer] >= maxOrphansPerPeer {
+		return false
+	}
+
+	if len(p.blocks) >= maxOrphans {
+		var oldest string
+		for h, o := range p.blocks {
+			if oldest == "" || o.expiry.Before(p.blocks[oldest].expiry) {
+				oldest = h
+			}
+		}
+		p.remove(oldest)
+	}
+
+	p.blocks[hash] = &orphan{block: block, peer: peer, expiry: now.Add(orphanTTL)}
+	parentHash := block.GetPrevHash()
+	if p.byParent[parentHash] == nil {
+		p.byParent[parentHash] = make(map[string]bool)
+	}
+	p.byParent[parentHash][hash] = true
+	p.perPeer[peer]++
+	return true
+}
+
+func (p *orphanPool) has(hash string) bool {
+	_, exists := p.blocks[hash]
+	return exists
+}
+
+func (p *orphanPool) len() int {
+	return len(p.blocks)
+}
+
+func (p *orphanPool) remove(hash string) {
+	o, exists := p.blocks[hash]
+	if !exists {
+		return
+	}
+	delete(p.blocks, hash)
+
+	parentHash := o.block.GetPrevHash()
+	delete(p.byParent[parentHash], hash)
+	if len(p.byParent[parentHash]) == 0 {
+		delete(p.byParent, parentHash)
+	}
+	if p.perPeer[o.peer]--; p.perPeer[o.peer] == 0 {
+		delete(p.perPeer, o.peer)
+	}
+}
+
+// Remove the orphans that waited orphanTTL for their parent
+func (p *orphanPool) expire(now time.Time) {
+	for hash, o := range p.blocks {
+		if now.After(o.expiry) {
+			p.remove(hash)
+		}
+	}
+}
+
+// Remove and return the orphans waiting for parentHash
+func (p *orphanPool) takeChildren(parentHash string) (children []*orphan) {
+	for hash := range p.byParent[parentHash] {
+		children = append(children, p.blocks[hash])
+	}
+	for _, child := range children {
+		p.remove(child.block.Hash())
+	}
+	return children
+}
+
+// Return the parents the orphans wait for that are not orphans themselves,
+// with the neighbour that sent one of their children
+func (p *orphanPool) parents() map[string]string {
+	parents := make(map[string]string)
+	for parentHash, hashes := range p.byParent {
+		if p.has(parentHash) {
+			continue
+		}
+		for hash := range hashes {
+			parents[parentHash] = p.blocks[hash].peer
+			break
+		}
+	}
+	return parents
+}
+
+// Return the orphans, oldest first
+func (p *orphanPool) list() (blocks []Block) {
+	for _, o := range p.blocks {
+		blocks = append(blocks, o.block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].GetTimestamp() < blocks[j].GetTimestamp() })
+	return blocks
+}
+
+// ---------------------------------------------------------------------
+// Fetching the ancestors of the orphans
+// ---------------------------------------------------------------------
+
+// Periodically fetch the missing ancestors of the orphans, until Stop
+func (e *Engine) dequeueBlocks() {
+	for {
+		e.fetchOrphanAncestors()
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(orphanFetchInterval):
+		}
+	}
+}
+
+// Expire old orphans, add the ones whose parent arrived, and fetch every
+// missing parent, then its parent and so on until a block in the tree is
+// reached. If the pool can't hold the ancestors, the miner is too far
+// behind for that: sync with the network instead.
+func (e *Engine) fetchOrphanAncestors() {
+	e.lock.Lock()
+	e.orphans.expire(time.Now())
+	missing := make(map[string]string)
+	var added []Block
+	for parentHash, peer := range e.orphans.parents() {
+		if _, inTree := e.treeTable[parentHash]; inTree {
+			added = append(added, e.connectOrphans(parentHash)...)
+		} else {
+			missing[parentHash] = peer
+		}
+	}
+	e.lock.Unlock()
+
+	for _, block := range added {
+		e.FloodMinerNetworkBlock(block)
+	}
+
+	behind := false
+	for hash, peer := range missing {
+		for {
+			block, from, err := e.fetchBlock(hash, peer)
+			if err != nil {
+				Log.Error("Unable to fetch missing block [%s], err: %s", hash, err.Error())
+				break
+			}
+
+			if e.HasBlock(block.GetPrevHash()) {
+				e.disseminateBlock(block, from)
+				break
+			}
+			known, accepted := e.addOrphan(block, from)
+			if known {
+				// Its ancestors are fetched already
+				break
+			}
+			if !accepted {
+				behind = true
+				break
+			}
+			hash, peer = block.GetPrevHash(), from
+		}
+	}
+
+	if behind {
+		Log.Debug("Too many missing ancestors, syncing with the network")
+		e.SyncWithNetwork()
+	}
+}
+
+// Add block, sent by peer, to the orphans. known is true if it is an
+// orphan already, accepted is false if the pool refused it.
+func (e *Engine) addOrphan(block Block, peer string) (known bool, accepted bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.orphans.has(block.Hash()) {
+		return true, false
+	}
+	return false, e.orphans.add(block, peer, time.Now())
+}
+
+// Add the orphans waiting for parentHash to the tree, then the ones waiting
+// for them, and so on. Return the blocks added.
+// Precondition: e.lock is held for writing, parentHash is in treeTable
+func (e *Engine) connectOrphans(parentHash string) (added []Block) {
+	parents := []string{parentHash}
+	for len(parents) > 0 {
+		children := e.orphans.takeChildren(parents[0])
+		parents = parents[1:]
+		for _, child := range children {
+			if _, inTree := e.treeTable[child.block.Hash()]; inTree {
+				continue
+			}
+			validated, err := e.validateBlock(child.block)
+			if !validated || err != nil {
+				Log.Error("orphan block [%s] is not valid [%v]", child.block.Hash(), err)
+				continue
+			}
+			e.addBlockToBlockchain(child.block)
+			added = append(added, child.block)
+			parents = append(parents, child.block.Hash())
+		}
+	}
+	return added
+}
+
+// Fetch the block with the given hash, from peer first, then from the
+// other neighbours. Return the public key of the neighbour that sent it.
+// Can return the following errors:
+// - InvalidBlockHashError
+func (e *Engine) fetchBlock(hash string, peer string) (block Block, from string, err error) {
+	neighbours := e.Transport.Neighbours()
+	pubKeys := make([]string, 0, len(neighbours))
+	if _, connected := neighbours[peer]; connected {
+		pubKeys = append(pubKeys, peer)
+	}
+	for pubKey := range neighbours {
+		if pubKey != peer {
+			pubKeys = append(pubKeys, pubKey)
+		}
+	}
+
+	for _, pubKey := range pubKeys {
+		var reply GeneralBlock
+		if err := callPeer(neighbours[pubKey], "MinerMinerRPC.GetBlockFromHash", hash, &reply); err != nil {
+			continue
+		}
+		// Only the block asked for
+		if block = reply.ToBlock(); block.Hash() == hash {
+			return block, pubKey, nil
+		}
+	}
+	return nil, "", shared.InvalidBlockHashError(hash)
+}
@@ -0,0 +1,136 @@
+package miner
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// A miner that missed blocks fetches the ancestors of the block it got
+// until it reaches its own chain
+func TestFetchOrphanAncestors(t *testing.T) {
+	settings := testSettings
+	a := newTestEngineWithInk(t, settings, 10)
+	defer os.RemoveAll(a.DataDir)
+	a.initialized = true
+	chain := a.GetLongestChain()
+
+	b := newTestEngineWithInk(t, settings, 0)
+	defer os.RemoveAll(b.DataDir)
+	b.initialized = true
+	for _, block := range chain[:3] {
+		b.AddBlockToBlockchain(block)
+	}
+	connectTestEngines(t, b, a)
+
+	if err := b.disseminateBlockFrom(chain[9], a.PubKeyStr); err == nil {
+		t.Fatalf("block without parent added")
+	}
+	if status := b.GetStatus(); status.NoParentBlocks != 1 {
+		t.Fatalf("expected 1 block waiting for its parent, got [%d]", status.NoParentBlocks)
+	}
+
+	b.fetchOrphanAncestors()
+	if leaf := b.LongestLeafHash(); leaf != a.LongestLeafHash() {
+		t.Errorf("caught up to [%s], expected [%s]", leaf, a.LongestLeafHash())
+	}
+	if status := b.GetStatus(); status.NoParentBlocks != 0 {
+		t.Errorf("[%d] blocks still waiting for their parent", status.NoParentBlocks)
+	}
+}
+
+func TestOrphanPoolLimits(t *testing.T) {
+	orphanBlock := func(i int) Block {
+		return NoOpBlock{PrevHash: "missing", Nonce: uint32(i)}
+	}
+	pool := newOrphanPool()
+	now := time.Now()
+
+	// Per neighbour
+	for i := 0; i < maxOrphansPerPeer; i++ {
+		if !pool.add(orphanBlock(i), "peer", now.Add(time.Duration(i)*time.Millisecond)) {
+			t.Fatalf("orphan [%d] refused", i)
+		}
+	}
+	if pool.add(orphanBlock(maxOrphansPerPeer), "peer", now) {
+		t.Errorf("neighbour exceeded maxOrphansPerPeer")
+	}
+
+	// In total, the oldest make room
+	for i := maxOrphansPerPeer; i < maxOrphans+10; i++ {
+		pool.add(orphanBlock(i), string(rune('a'+i%16)), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if pool.len() != maxOrphans || pool.has(orphanBlock(0).Hash()) {
+		t.Errorf("expected the [%d] newest orphans, got [%d]", maxOrphans, pool.len())
+	}
+	if parents := pool.parents(); len(parents) != 1 {
+		t.Errorf("expected 1 missing parent, got [%d]", len(parents))
+	}
+
+	pool.expire(now.Add(orphanTTL + time.Hour))
+	if pool.len() != 0 || len(pool.byParent) != 0 || len(pool.perPeer) != 0 {
+		t.Errorf("expired orphans left in the pool")
+	}
+}
+
+// A copy of the last op of an odd Merkle level leaves the block hash
+// unchanged: such a block is refused before it is kept as an orphan, so
+// the real block is still added when it arrives
+func TestDuplicateOpsNotCached(t *testing.T) {
+	settings := testSettings
+	a := newTestEngineWithInk(t, settings, 3)
+	defer os.RemoveAll(a.DataDir)
+	a.initialized = true
+
+	parent := NoOpBlock{Version: settings.BlockVersion, PrevHash: a.LongestLeafHash(), PubKeyMiner: a.PubKeyStr, Timestamp: BlockTimestamp(time.Now()) + 10}
+	ops := []Op{testOp(t, a, 100, 0), testOp(t, a, 200, 0), testOp(t, a, 300, 0)}
+	block := OpBlock{Version: settings.BlockVersion, PrevHash: parent.Hash(), Ops: ops, PubKeyMiner: a.PubKeyStr, Timestamp: parent.Timestamp + 1}
+	copied := block
+	copied.Ops = append(append([]Op{}, ops...), ops[2])
+	if copied.Hash() != block.Hash() {
+		t.Fatalf("expected the same hash with a copied op")
+	}
+
+	if _, err := a.addBlockIfNew(copied, "peer"); err == nil {
+		t.Errorf("block with a copied op accepted")
+	}
+	if a.orphans.has(block.Hash()) {
+		t.Fatalf("block with a copied op kept as an orphan")
+	}
+
+	// Dev PoW accepts any nonce
+	a.AddBlockToBlockchain(parent)
+	if _, err := a.addBlockIfNew(block, "peer"); err != nil || !a.HasBlock(block.Hash()) {
+		t.Errorf("real block not added [%v]", err)
+	}
+}
+
+// A block without parent only takes a slot in the pool if it meets the
+// configured difficulty
+func TestOrphanProofOfWork(t *testing.T) {
+	settings := testSettings
+	settings.PoWAlgorithm = PoWHashPrefix
+	settings.PoWDifficultyInBits = true
+	settings.PoWDifficultyNoOpBlock = 12
+	e, _ := newTestEngine(t, settings)
+	defer os.RemoveAll(e.DataDir)
+
+	// Misses 12 zero bits with a chance of 1 in 4096 per nonce
+	block := NoOpBlock{Version: settings.BlockVersion, PrevHash: "missing", PubKeyMiner: e.PubKeyStr, Timestamp: BlockTimestamp(time.Now())}
+	for e.pow.Verify(block.Header(), 12) {
+		block.Nonce++
+	}
+	if _, err := e.addBlockIfNew(block, ""); err == nil || e.orphans.has(block.Hash()) {
+		t.Errorf("block without proof of work kept as an orphan")
+	}
+
+	header, found := e.pow.Seal(context.Background(), block.Header(), 12)
+	if !found {
+		t.Fatalf("no nonce found")
+	}
+	block.Nonce, block.ExtraNonce = header.Nonce, header.ExtraNonce
+	if e.addBlockIfNew(block, ""); !e.orphans.has(block.Hash()) {
+		t.Errorf("mined block without parent not kept as an orphan")
+	}
+}
@@ -0,0 +1,134 @@
+package miner
+
+import (
+	"../shared"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Names of the proof of work algorithms, for MinerNetSettings.PoWAlgorithm
+const (
+	PoWHashPrefix = "hash-prefix"
+	PoWMemoryHard = "memory-hard"
+	PoWDev        = "dev"
+)
+
+// Proof of work algorithm sealing and checking block headers
+type PoW interface {
+	// Find the nonces making header meet difficulty.
+	// found is false if ctx is cancelled first.
+	Seal(ctx context.Context, header shared.BlockHeader, difficulty uint8) (sealed shared.BlockHeader, found bool)
+
+	// Return true if the header's nonces meet difficulty
+	Verify(header shared.BlockHeader, difficulty uint8) bool
+
+	// Return the difficulty in leading zero bits the algorithm requires
+	// where the chain's retargeted difficulty is difficulty
+	Difficulty(difficulty uint8) uint8
+}
+
+// Return the proof of work algorithm the network settings select
+// Defaults to the hash-prefix scheme
+func NewPoW(settings MinerNetSettings) (pow PoW, err error) {
+	switch settings.PoWAlgorithm {
+	case "", PoWHashPrefix:
+		return HashPrefixPoW{}, nil
+	case PoWMemoryHard:
+		return MemoryHardPoW{ScratchpadSize: memoryHardScratchpadSize}, nil
+	case PoWDev:
+		return DevPoW{BlockInterval: time.Duration(settings.TargetBlockInterval) * time.Millisecond}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proof of work [%s]", settings.PoWAlgorithm)
+	}
+}
+
+// ---------------------------------------------------------------------
+// Hash prefix: the block hash starts with difficulty zero bits
+// ---------------------------------------------------------------------
+
+type HashPrefixPoW struct{}
+
+func (pow HashPrefixPoW) Seal(ctx context.Context, header shared.BlockHeader, difficulty uint8) (sealed shared.BlockHeader, found bool) {
+	return sealWithWorkers(ctx, header, difficulty, shared.BlockHeader.HashToBytes)
+}
+
+func (pow HashPrefixPoW) Verify(header shared.BlockHeader, difficulty uint8) bool {
+	return shared.LeadingZeroBits(header.HashToBytes()) >= int(difficulty)
+}
+
+func (pow HashPrefixPoW) Difficulty(difficulty uint8) uint8 {
+	return difficulty
+}
+
+// ---------------------------------------------------------------------
+// Memory hard: every hash needs a scratchpad of ScratchpadSize hashes
+// ---------------------------------------------------------------------
+
+// Number of SHA-256 hashes in the default scratchpad: 128 KiB per worker
+const memoryHardScratchpadSize = 1 << 12
+
+type MemoryHardPoW struct {
+	ScratchpadSize int
+}
+
+func (pow MemoryHardPoW) Seal(ctx context.Context, header shared.BlockHeader, difficulty uint8) (sealed shared.BlockHeader, found bool) {
+	return sealWithWorkers(ctx, header, difficulty, pow.hash)
+}
+
+func (pow MemoryHardPoW) Verify(header shared.BlockHeader, difficulty uint8) bool {
+	return shared.LeadingZeroBits(pow.hash(header)) >= int(difficulty)
+}
+
+func (pow MemoryHardPoW) Difficulty(difficulty uint8) uint8 {
+	return difficulty
+}
+
+// Fill the scratchpad with a SHA-256 chain seeded by the block hash, then
+// mix in as many entries picked by the running hash, so each hash needs
+// the whole scratchpad in memory.
+func (pow MemoryHardPoW) hash(header shared.BlockHeader) []byte {
+	x := sha256.Sum256(header.HashToBytes())
+	scratchpad := make([][sha256.Size]byte, pow.ScratchpadSize)
+	for i := range scratchpad {
+		scratchpad[i] = x
+		x = sha256.Sum256(x[:])
+	}
+
+	for range scratchpad {
+		entry := scratchpad[binary.BigEndian.Uint32(x[:4])%uint32(len(scratchpad))]
+		for k := range x {
+			x[k] ^= entry[k]
+		}
+		x = sha256.Sum256(x[:])
+	}
+	return x[:]
+}
+
+// ---------------------------------------------------------------------
+// Dev: no work, blocks are sealed every BlockInterval, for tests and demos
+// ---------------------------------------------------------------------
+
+type DevPoW struct {
+	BlockInterval time.Duration
+}
+
+func (pow DevPoW) Seal(ctx context.Context, header shared.BlockHeader, difficulty uint8) (sealed shared.BlockHeader, found bool) {
+	select {
+	case <-time.After(pow.BlockInterval):
+		return header, true
+	case <-ctx.Done():
+		return header, false
+	}
+}
+
+func (pow DevPoW) Verify(header shared.BlockHeader, difficulty uint8) bool {
+	return true
+}
+
+// Every block weighs the same, so fork choice picks the most blocks
+func (pow DevPoW) Difficulty(difficulty uint8) uint8 {
+	return 0
+}
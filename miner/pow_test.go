@@ -0,0 +1,55 @@
+package miner
+
+import (
+	"../shared"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPoWSealVerify(t *testing.T) {
+	header := shared.BlockHeader{
+		Version:   shared.BlockVersion2,
+		PrevHash:  "83218ac34c1834c26781fe4bde918ee4",
+		Timestamp: 1,
+	}
+	algorithms := map[string]PoW{
+		PoWHashPrefix: HashPrefixPoW{},
+		PoWMemoryHard: MemoryHardPoW{ScratchpadSize: 1 << 8},
+		PoWDev:        DevPoW{},
+	}
+	for name, pow := range algorithms {
+		const difficulty = 8
+		sealed, found := pow.Seal(context.Background(), header, difficulty)
+		if !found || !pow.Verify(sealed, pow.Difficulty(difficulty)) {
+			t.Errorf("%s: sealed header does not verify", name)
+		}
+	}
+
+	// A header sealed by one algorithm is not proof for another
+	sealed, _ := HashPrefixPoW{}.Seal(context.Background(), header, 16)
+	if (MemoryHardPoW{ScratchpadSize: 1 << 8}).Verify(sealed, 16) {
+		t.Errorf("hash-prefix seal verified as memory-hard")
+	}
+}
+
+func TestNewPoW(t *testing.T) {
+	settings := testSettings
+	settings.PoWAlgorithm = PoWDev
+	settings.TargetBlockInterval = 50
+	pow, err := NewPoW(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev, ok := pow.(DevPoW); !ok || dev.BlockInterval != 50*time.Millisecond {
+		t.Errorf("dev PoW not selected [%v]", pow)
+	}
+	if pow.Difficulty(20) != 0 {
+		t.Errorf("dev PoW should require no work")
+	}
+
+	settings.PoWAlgorithm = "sha3"
+	if _, err := NewPoW(settings); err == nil {
+		t.Errorf("unknown algorithm accepted")
+	}
+}
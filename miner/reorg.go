@@ -0,0 +1,117 @@
+package miner
+
+// Switch from one branch of the tree to another as the longest chain
+type Reorg struct {
+	OldLeafHash    string
+	NewLeafHash    string
+	CommonAncestor string
+
+	// Blocks removed from the longest chain, old leaf first
+	Disconnected []string
+	// Blocks added to the longest chain, oldest first
+	Connected []string
+}
+
+// Compute the blocks to disconnect and connect to move the longest chain
+// from oldLeafHash to newLeafHash
+// Precondition: both hashes are in treeTable, e.lock is held
+func (e *Engine) FindReorg(oldLeafHash, newLeafHash string) (reorg Reorg) {
+	reorg.OldLeafHash = oldLeafHash
+	reorg.NewLeafHash = newLeafHash
+
+	oldHash, newHash := oldLeafHash, newLeafHash
+	var connected []string
+
+	// Walk the higher branch down until both are at the same height
+	for e.treeTable[oldHash].Height > e.treeTable[newHash].Height {
+		reorg.Disconnected = append(reorg.Disconnected, oldHash)
+		oldHash = e.treeTable[oldHash].Block.GetPrevHash()
+	}
+	for e.treeTable[newHash].Height > e.treeTable[oldHash].Height {
+		connected = append(connected, newHash)
+		newHash = e.treeTable[newHash].Block.GetPrevHash()
+	}
+
+	// Then walk both down until they meet
+	for oldHash != newHash {
+		reorg.Disconnected = append(reorg.Disconnected, oldHash)
+		connected = append(connected, newHash)
+		oldHash = e.treeTable[oldHash].Block.GetPrevHash()
+		newHash = e.treeTable[newHash].Block.GetPrevHash()
+	}
+	reorg.CommonAncestor = oldHash
+
+	// connected was collected leaf first
+	for i := len(connected) - 1; i >= 0; i-- {
+		reorg.Connected = append(reorg.Connected, connected[i])
+	}
+
+	return reorg
+}
+
+// Make newLeafHash the block the miner extends.
+// Ops in the newly connected blocks leave opQueue. The queued ops were
+// validated against the old leaf: the ones the new leaf makes invalid, such
+// as ops overspending after another op of their signer was mined, are
+// dropped. On a reorg, ops only in the disconnected blocks are re-queued if
+// they are still valid on the new leaf, and dropped otherwise.
+// Dropped ops are published as OpDropped.
+// Precondition: e.lock is held for writing
+func (e *Engine) setLongestLeaf(newLeafHash string) {
+	reorg := e.FindReorg(e.longestLeafHash, newLeafHash)
+	e.longestLeafHash = newLeafHash
+	e.interruptMining()
+	defer e.publishReorg(reorg)
+
+	for _, blockHash := range reorg.Connected {
+		for _, op := range e.treeTable[blockHash].Block.GetOps() {
+			opHash := op.HashToString()
+			e.dequeueOp(opHash)
+		}
+	}
+
+	ctx, err := e.newValidationContext(newLeafHash)
+	if err != nil {
+		Log.Error("Panic: invariant violated, new leaf not in tree [%s]", err.Error())
+		return
+	}
+
+	// Each queued op alone, the way queueOp validated it against the old leaf
+	for _, opHash := range e.queuedOpHashes() {
+		validated, err := ValidateOp(ctx, *e.opQueue[opHash])
+		if !validated || err != nil {
+			Log.Debug("Dropping queued op [%s] [%v]", opHash, err)
+			e.dequeueOp(opHash)
+			e.publish(ChainEvent{Type: OpDropped, OpHash: opHash, Err: err})
+		}
+	}
+
+	if len(reorg.Disconnected) == 0 {
+		// The new leaf extends the old one
+		return
+	}
+
+	Log.Debug("Reorg from [%s] to [%s], ancestor [%s], disconnected [%d], connected [%d]",
+		reorg.OldLeafHash, reorg.NewLeafHash, reorg.CommonAncestor, len(reorg.Disconnected), len(reorg.Connected))
+
+	// Oldest disconnected block first, so ops are re-validated in chain order
+	for i := len(reorg.Disconnected) - 1; i >= 0; i-- {
+		for _, op := range e.treeTable[reorg.Disconnected[i]].Block.GetOps() {
+			opHash := op.HashToString()
+			if _, onNewChain := ctx.State.OpLog.Get(opHash); onNewChain {
+				continue
+			}
+
+			validated, err := ValidateOp(ctx, op)
+			if !validated || err != nil {
+				Log.Debug("Dropping orphaned op [%s] [%v]", opHash, err)
+				e.publish(ChainEvent{Type: OpDropped, OpHash: opHash, Err: err})
+				continue
+			}
+			ctx.ApplyOp(op)
+
+			e.enqueueOp(opHash, op)
+			Log.Debug("Re-queued orphaned op [%s]", opHash)
+		}
+	}
+}
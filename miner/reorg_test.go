@@ -0,0 +1,131 @@
+package miner
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// On a reorg, ops only in the abandoned branch go back into the queue if
+// they are still valid on the new branch, and queued ops that the new
+// branch makes invalid are dropped
+func TestReorgRequeuesAndDropsOps(t *testing.T) {
+	settings := testSettings
+	e := newTestEngineWithInk(t, settings, 3)
+	defer os.RemoveAll(e.DataDir)
+	other, _ := newTestEngine(t, settings)
+	defer os.RemoveAll(other.DataDir)
+
+	const miner = "0123456789abcdef"
+	timestamp := BlockTimestamp(time.Now()) + 10
+	nextBlock := func(prevHash string, ops []Op) Block {
+		timestamp++
+		if len(ops) == 0 {
+			return NoOpBlock{Version: settings.BlockVersion, PrevHash: prevHash, PubKeyMiner: other.PubKeyStr, Timestamp: timestamp}
+		}
+		return OpBlock{Version: settings.BlockVersion, PrevHash: prevHash, Ops: ops, PubKeyMiner: miner, Timestamp: timestamp}
+	}
+
+	// other's ink, on the chain both branches share
+	fork := nextBlock(e.LongestLeafHash(), nil)
+	e.AddBlockToBlockchain(fork)
+
+	// Old branch: still valid on the new branch, then overlapping other's shape
+	requeued, dropped := testOp(t, e, 100, 0), testOp(t, e, 500, 0)
+	old := nextBlock(fork.Hash(), []Op{requeued, dropped})
+	e.AddBlockToBlockchain(old)
+
+	// Queued on the old branch: overlapping other's shape, then still valid
+	queuedDropped, queuedKept := testOp(t, e, 700, 0), testOp(t, e, 900, 0)
+	for _, op := range []Op{queuedDropped, queuedKept} {
+		if ok, err := e.queueOp(op); !ok || err != nil {
+			t.Fatalf("op not queued [%v]", err)
+		}
+	}
+
+	sub := e.Subscribe()
+	defer e.Unsubscribe(sub)
+	newBranch := nextBlock(fork.Hash(), []Op{testOp(t, other, 500, 0), testOp(t, other, 700, 0)})
+	e.AddBlockToBlockchain(newBranch)
+	longer := nextBlock(newBranch.Hash(), nil)
+	e.AddBlockToBlockchain(longer)
+	if e.LongestLeafHash() != longer.Hash() {
+		t.Fatalf("no reorg to the longer branch")
+	}
+
+	for _, op := range []Op{requeued, queuedKept} {
+		if _, queued := e.GetQueuedOp(op.HashToString()); !queued {
+			t.Errorf("valid op [%s] not queued after the reorg", op.Op.Svg)
+		}
+	}
+	droppedOps := map[string]bool{dropped.HashToString(): true, queuedDropped.HashToString(): true}
+	for opHash := range droppedOps {
+		if _, queued := e.GetQueuedOp(opHash); queued {
+			t.Errorf("invalid op [%s] still queued after the reorg", opHash)
+		}
+	}
+	for len(droppedOps) > 0 {
+		select {
+		case event := <-sub.Events:
+			if event.Type == OpDropped {
+				if !droppedOps[event.OpHash] {
+					t.Errorf("op [%s] dropped", event.OpHash)
+				}
+				delete(droppedOps, event.OpHash)
+			}
+		default:
+			t.Fatalf("[%d] dropped ops not published", len(droppedOps))
+		}
+	}
+}
+
+// Without a reorg too, queued ops the new block makes invalid are dropped:
+// an op overspending once its signer's other op is mined
+func TestExtendDropsInvalidQueuedOps(t *testing.T) {
+	settings := testSettings
+	e := newTestEngineWithInk(t, settings, 1)
+	defer os.RemoveAll(e.DataDir)
+
+	const miner = "0123456789abcdef"
+	ink := e.GetInk(e.PubKeyStr)
+
+	// Each op's fee is more than half of the signer's ink
+	withFee := func(x int) Op {
+		op := testOp(t, e, x, 0)
+		op.Fee = ink/2 + 1
+		return signTestOp(t, e, op)
+	}
+	mined, overspending := withFee(100), withFee(500)
+	for _, op := range []Op{mined, overspending} {
+		if ok, err := e.queueOp(op); !ok || err != nil {
+			t.Fatalf("op not queued [%v]", err)
+		}
+	}
+
+	sub := e.Subscribe()
+	defer e.Unsubscribe(sub)
+	leafHash := e.LongestLeafHash()
+	block := OpBlock{Version: settings.BlockVersion, PrevHash: leafHash, Ops: []Op{mined}, PubKeyMiner: miner, Timestamp: BlockTimestamp(time.Now()) + 10}
+	e.AddBlockToBlockchain(block)
+	if e.LongestLeafHash() != block.Hash() {
+		t.Fatalf("block does not extend the longest chain")
+	}
+
+	if queued := e.GetQueuedOps(); len(queued) != 0 {
+		t.Errorf("[%d] ops still queued", len(queued))
+	}
+	for {
+		select {
+		case event := <-sub.Events:
+			if event.Type != OpDropped {
+				continue
+			}
+			if event.OpHash != overspending.HashToString() || event.Err == nil {
+				t.Errorf("op [%s] dropped [%v]", event.OpHash, event.Err)
+			}
+			return
+		default:
+			t.Fatalf("overspending op not published as dropped")
+		}
+	}
+}
@@ -9,7 +9,8 @@ import (
 type Shape struct {
 	Owner             string // public key hash of the shape owner
 	ShapeType         shared.ShapeType
-	Svg, Fill, Stroke string // addshape args
+	Svg, Fill, Stroke string              // addshape args
+	Version           shared.BlockVersion // selects the hash function, same as the network's blocks
 }
 
 func (s Shape) Area() (uint64, error) {
@@ -128,7 +129,7 @@ func (s Shape) HashToString() (hashedShape string) {
 // Hash Shape's fields
 // Fields: owner, svg, fill, stroke, components
 func (s Shape) HashToBytes() (hashedShape []byte) {
-	return shared.HashByteArr(shared.Serialize(s.Svg + s.Fill + s.Stroke))
+	return s.Version.Hash(shared.Serialize(s.Svg + s.Fill + s.Stroke))
 }
 
 // Returns the svg, fill, stroke of the shape
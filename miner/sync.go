@@ -0,0 +1,357 @@
+package miner
+
+import (
+	"../shared"
+	"math/big"
+	"sort"
+	"sync"
+)
+
+// ---------------------------------------------------------------------
+// Headers-first chain sync: a joining or restarted miner sends a block
+// locator, gets the headers its neighbours have after the fork point,
+// checks their proof of work, then fetches the bodies from several
+// neighbours at once.
+// ---------------------------------------------------------------------
+
+const (
+	// Most headers returned by one GetHeaders call
+	maxHeadersPerCall = 500
+
+	// Blocks asked for in one GetBlocks call while syncing
+	syncBatchSize = 50
+
+	// Hashes listed one by one at the top of a locator, before the gaps double
+	locatorDenseBlocks = 10
+
+	// Most headers fetched from one neighbour in a sync round; the blocks
+	// after them are synced in the next round
+	maxSyncHeaders = 100 * maxHeadersPerCall
+)
+
+// Arguments of GetHeaders
+type LocatorArgs struct {
+	// Hashes of blocks on the caller's longest chain, newest first,
+	// ending at Genesis, see blockLocator
+	Locator []string
+
+	// Most headers to return
+	Max int
+}
+
+// Return hashes of the longest chain, newest first: the last
+// locatorDenseBlocks one by one, then twice as far apart each time,
+// ending at Genesis. The locator stays short however long the chain is.
+func (e *Engine) blockLocator() (locator []string) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	node := e.treeTable[e.longestLeafHash]
+	step := 1
+	for node.Height > 0 {
+		locator = append(locator, node.Block.Hash())
+		if len(locator) >= locatorDenseBlocks {
+			step *= 2
+		}
+		for i := 0; i < step && node.Height > 0; i++ {
+			node = e.treeTable[node.Block.GetPrevHash()]
+		}
+	}
+	return append(locator, e.Settings.GenesisBlockHash)
+}
+
+// Return the headers of the longest chain after the newest locator hash on
+// it, at most max. Genesis ends every locator, so at worst the headers start
+// at the first block. Only the blocks after the fork point are visited.
+func (e *Engine) HeadersAfter(locator []string, max int) (headers []shared.BlockHeader) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	inLocator := make(map[string]bool, len(locator))
+	for _, hash := range locator {
+		inLocator[hash] = true
+	}
+
+	// Walk back from the leaf to the newest locator block on the longest chain
+	distance := 0
+	for hash := e.longestLeafHash; hash != e.Settings.GenesisBlockHash && !inLocator[hash]; distance++ {
+		hash = e.treeTable[hash].Block.GetPrevHash()
+	}
+
+	// Skip the blocks past the first max after the fork point, then
+	// collect the rest leaf first
+	node := e.treeTable[e.longestLeafHash]
+	for skip := distance - max; skip > 0; skip-- {
+		node = e.treeTable[node.Block.GetPrevHash()]
+	}
+	if distance > max {
+		distance = max
+	}
+	headers = make([]shared.BlockHeader, distance)
+	for i := distance - 1; i >= 0; i-- {
+		headers[i] = node.Block.Header()
+		node = e.treeTable[node.Block.GetPrevHash()]
+	}
+	return headers
+}
+
+// Check that headers extend a block in the tree, link up, and each meets the
+// difficulty the chain retargets to. Return the total work of the chain they
+// lead to. The fork point is read under e.lock, the proofs of work are
+// checked without it: with a memory-hard PoW they take long.
+// Can return the following errors:
+// - InvalidBlockHashError
+func (e *Engine) verifyHeaders(headers []shared.BlockHeader) (work *big.Int, err error) {
+	e.lock.RLock()
+	fork, exists := e.treeTable[headers[0].PrevHash]
+	if !exists {
+		e.lock.RUnlock()
+		return nil, shared.InvalidBlockHashError("headers do not extend the blockchain")
+	}
+	forkHeight, shift := fork.Height, fork.DifficultyShift
+	work = new(big.Int).Set(fork.TotalWork)
+
+	// Timestamps of the ancestors a retarget may measure from, up to the
+	// fork point, see retargetShift
+	// Key: height
+	ancestorTimestamps := make(map[int]int64)
+	for node := fork; node.Height > 0 && node.Height > forkHeight-int(e.Settings.RetargetInterval); {
+		ancestorTimestamps[node.Height] = node.Block.GetTimestamp()
+		node = e.treeTable[node.Block.GetPrevHash()]
+	}
+	e.lock.RUnlock()
+
+	// Ancestors up to the fork point were copied, the ones after are headers
+	timestampAt := func(height int) int64 {
+		if height > forkHeight {
+			return headers[height-forkHeight-1].Timestamp
+		}
+		return ancestorTimestamps[height]
+	}
+
+	prevHash := headers[0].PrevHash
+	for i, header := range headers {
+		if header.PrevHash != prevHash {
+			return nil, shared.InvalidBlockHashError("headers are not linked at " + header.Hash())
+		}
+		if header.Version != e.Settings.BlockVersion {
+			return nil, shared.InvalidBlockHashError("unexpected block version in header " + header.Hash())
+		}
+
+		// Only an OpBlock has a Merkle root
+		difficulty := e.shiftedDifficulty(header.MerkleRoot != "", shift)
+		if !e.pow.Verify(header, difficulty) {
+			return nil, shared.InvalidBlockHashError("invalid nonce in header " + header.Hash())
+		}
+
+		work.Add(work, BlockWork(difficulty))
+		shift = e.retargetShift(shift, header.Timestamp, forkHeight+i+1, timestampAt)
+		prevHash = header.Hash()
+	}
+	return work, nil
+}
+
+// Fetch the headers the neighbour has after our longest chain,
+// maxHeadersPerCall at a time, at most maxSyncHeaders
+// Can return the following errors:
+// - PeerTimeoutError
+// - errors of the call
+func (e *Engine) fetchHeaders(conn Peer) (headers []shared.BlockHeader, err error) {
+	locator := e.blockLocator()
+	for {
+		var reply []shared.BlockHeader
+		err = callPeer(conn, "MinerMinerRPC.GetHeaders", LocatorArgs{Locator: locator, Max: maxHeadersPerCall}, &reply)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, reply...)
+		if len(reply) < maxHeadersPerCall || len(headers) >= maxSyncHeaders {
+			return headers, nil
+		}
+		// Carry on from the last header
+		locator = append([]string{reply[len(reply)-1].Hash()}, locator...)
+	}
+}
+
+// Sync the tree with the neighbours: pick the header chain with the most
+// work beyond our longest chain, then fetch its blocks, in batches spread
+// over the neighbours holding them, and add them in order. Rounds go on
+// while a neighbour has more than maxSyncHeaders blocks to send.
+// Sync time grows with the number of missing blocks, not the chain length.
+func (e *Engine) SyncWithNetwork() {
+	for e.syncRound() {
+	}
+}
+
+// Catch up on the blocks missed while poorly connected. Nothing to do
+// while initializing, InitBlockchain syncs before adding blocks.
+func (e *Engine) ResyncWithNetwork() {
+	e.lock.RLock()
+	initialized := e.initialized
+	e.lock.RUnlock()
+
+	if initialized {
+		e.SyncWithNetwork()
+	}
+}
+
+// Run one round of SyncWithNetwork, return true if a neighbour had more
+// blocks than the round fetched
+func (e *Engine) syncRound() (more bool) {
+	neighbours := e.Transport.Neighbours()
+
+	bestWork := e.longestChainWork()
+	var best []shared.BlockHeader
+
+	// Header hashes each neighbour returned
+	// Key: neighbour's public key
+	held := make(map[string]map[string]bool)
+
+	for pubKey, conn := range neighbours {
+		headers, err := e.fetchHeaders(conn)
+		if err != nil {
+			Log.Error("Unable to get headers from miner [%s], err: %s ", pubKey, err.Error())
+			continue
+		}
+		if len(headers) == 0 {
+			continue
+		}
+		work, err := e.verifyHeaders(headers)
+		if err != nil {
+			Log.Error("Bad headers from miner [%s], err: %s ", pubKey, err.Error())
+			continue
+		}
+
+		held[pubKey] = make(map[string]bool, len(headers))
+		for _, header := range headers {
+			held[pubKey][header.Hash()] = true
+		}
+		if work.Cmp(bestWork) > 0 {
+			best, bestWork = headers, work
+		}
+	}
+	if len(best) == 0 {
+		return false
+	}
+	Log.Debug("Syncing [%d] blocks after [%s]", len(best), best[0].PrevHash)
+
+	blocks := e.fetchBodies(best, held, neighbours)
+	for i, block := range blocks {
+		if block == nil {
+			Log.Error("sync stopped, no neighbour sent block [%s]", best[i].Hash())
+			return false
+		}
+		if _, err := e.addBlockIfNew(block, ""); err != nil {
+			Log.Error("sync block error [%s], [%v]", best[i].Hash(), err)
+			return false
+		}
+	}
+	return len(best) >= maxSyncHeaders
+}
+
+// Return the total work of the longest chain
+func (e *Engine) longestChainWork() *big.Int {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return new(big.Int).Set(e.treeTable[e.longestLeafHash].TotalWork)
+}
+
+// Fetch the blocks with the headers' hashes, in header order. Batches of
+// syncBatchSize blocks are shared out among the neighbours holding them,
+// which are called in parallel; a batch a neighbour fails to send is asked
+// from the others. A block no neighbour sent is nil.
+func (e *Engine) fetchBodies(headers []shared.BlockHeader, held map[string]map[string]bool, neighbours map[string]Peer) []Block {
+	index := make(map[string]int, len(headers))
+	for i, header := range headers {
+		index[header.Hash()] = i
+	}
+	blocks := make([]Block, len(headers))
+
+	// Return the neighbours holding every block of a batch: the ones
+	// holding its last block, since their headers are linked
+	holders := func(batch []shared.BlockHeader) (pubKeys []string) {
+		last := batch[len(batch)-1].Hash()
+		for pubKey, hashes := range held {
+			if hashes[last] {
+				pubKeys = append(pubKeys, pubKey)
+			}
+		}
+		sort.Strings(pubKeys)
+		return pubKeys
+	}
+
+	// Ask the batch from the neighbour, return false unless every block came
+	fetch := func(pubKey string, batch []shared.BlockHeader) bool {
+		hashes := make([]string, len(batch))
+		for i, header := range batch {
+			hashes[i] = header.Hash()
+		}
+		var reply RawGenBlockchain
+		if err := callPeer(neighbours[pubKey], "MinerMinerRPC.GetBlocks", hashes, &reply); err != nil {
+			Log.Error("Unable to get blocks from miner [%s], err: %s ", pubKey, err.Error())
+			return false
+		}
+		// Only the blocks of the batch, with the type their header commits to
+		received := make(map[string]Block, len(reply))
+		for _, genBlock := range reply {
+			block := genBlock.ToBlock()
+			received[block.Hash()] = block
+		}
+		complete := true
+		for _, header := range batch {
+			block, ok := received[header.Hash()]
+			if !ok || isOpBlock(block) != (header.MerkleRoot != "") {
+				complete = false
+				continue
+			}
+			blocks[index[header.Hash()]] = block
+		}
+		return complete
+	}
+
+	var batches [][]shared.BlockHeader
+	for start := 0; start < len(headers); start += syncBatchSize {
+		end := start + syncBatchSize
+		if end > len(headers) {
+			end = len(headers)
+		}
+		batches = append(batches, headers[start:end])
+	}
+
+	// Share the batches out round robin, one worker per neighbour
+	assigned := make(map[string][][]shared.BlockHeader)
+	for i, batch := range batches {
+		pubKeys := holders(batch)
+		pubKey := pubKeys[i%len(pubKeys)]
+		assigned[pubKey] = append(assigned[pubKey], batch)
+	}
+
+	var failedLock sync.Mutex
+	var failed [][]shared.BlockHeader
+	var wg sync.WaitGroup
+	for pubKey, batches := range assigned {
+		wg.Add(1)
+		go func(pubKey string, batches [][]shared.BlockHeader) {
+			defer wg.Done()
+			for _, batch := range batches {
+				if !fetch(pubKey, batch) {
+					failedLock.Lock()
+					failed = append(failed, batch)
+					failedLock.Unlock()
+				}
+			}
+		}(pubKey, batches)
+	}
+	wg.Wait()
+
+	// Retry the failed batches with every holder
+	for _, batch := range failed {
+		for _, pubKey := range holders(batch) {
+			if fetch(pubKey, batch) {
+				break
+			}
+		}
+	}
+	return blocks
+}
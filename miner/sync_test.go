@@ -0,0 +1,168 @@
+package miner
+
+import (
+	"../shared"
+	"math/big"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Connect e to the engines, only one way: e calls them
+func connectTestEngines(t *testing.T, e *Engine, others ...*Engine) {
+	for _, other := range others {
+		peer, err := e.Transport.Dial(other.MinerIPPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Transport.AddNeighbour(other.PubKeyStr, peer)
+	}
+}
+
+// Only the headers after the fork point are sent, and the blocks come
+// from every neighbour holding them
+func TestSyncWithNetwork(t *testing.T) {
+	settings := testSettings
+	a := newTestEngineWithInk(t, settings, 120)
+	defer os.RemoveAll(a.DataDir)
+	a.initialized = true
+	chain := a.GetLongestChain()
+
+	// c has a's chain, b its first 100 blocks, d nothing
+	b := newTestEngineWithInk(t, settings, 0)
+	defer os.RemoveAll(b.DataDir)
+	c := newTestEngineWithInk(t, settings, 0)
+	defer os.RemoveAll(c.DataDir)
+	d := newTestEngineWithInk(t, settings, 0)
+	defer os.RemoveAll(d.DataDir)
+	for i, block := range chain {
+		c.AddBlockToBlockchain(block)
+		if i < 100 {
+			b.AddBlockToBlockchain(block)
+		}
+	}
+
+	if headers := a.HeadersAfter(b.blockLocator(), maxHeadersPerCall); len(headers) != 20 || headers[0].PrevHash != chain[99].Hash() {
+		t.Fatalf("expected the 20 headers after block 100, got [%d]", len(headers))
+	}
+	if headers := a.HeadersAfter(d.blockLocator(), 30); len(headers) != 30 || headers[0].PrevHash != settings.GenesisBlockHash {
+		t.Fatalf("expected the first 30 headers, got [%d]", len(headers))
+	}
+
+	for _, e := range []*Engine{b, d} {
+		connectTestEngines(t, e, a, c)
+		e.SyncWithNetwork()
+		if leaf := e.LongestLeafHash(); leaf != a.LongestLeafHash() {
+			t.Errorf("synced to [%s], expected [%s]", leaf, a.LongestLeafHash())
+		}
+	}
+
+	// Headers must link up
+	headers := a.HeadersAfter(d.blockLocator()[len(d.blockLocator())-1:], 3)
+	headers[2].PrevHash = headers[0].Hash()
+	if _, err := d.verifyHeaders(headers); err == nil {
+		t.Errorf("unlinked headers accepted")
+	}
+}
+
+// A miner still initializing doesn't sync when reconnecting, and a caller
+// with our longest chain gets no headers
+func TestResyncBeforeInitialized(t *testing.T) {
+	a := newTestEngineWithInk(t, testSettings, 5)
+	defer os.RemoveAll(a.DataDir)
+	if headers := a.HeadersAfter(a.blockLocator(), maxHeadersPerCall); len(headers) != 0 {
+		t.Errorf("expected no headers, got [%d]", len(headers))
+	}
+
+	// No block store yet
+	b, _ := newTestEngine(t, testSettings)
+	defer os.RemoveAll(b.DataDir)
+	connectTestEngines(t, b, a)
+	b.ResyncWithNetwork()
+	if leaf := b.LongestLeafHash(); leaf != testSettings.GenesisBlockHash {
+		t.Errorf("synced to [%s] while initializing", leaf)
+	}
+}
+
+// Dev PoW weighing blocks by their difficulty, whose first Verify waits
+// until release is closed, if it is set
+type gatedPoW struct {
+	DevPoW
+	verifying chan struct{}
+	release   chan struct{}
+	once      sync.Once
+}
+
+func (pow *gatedPoW) Verify(header shared.BlockHeader, difficulty uint8) bool {
+	if pow.release != nil {
+		pow.once.Do(func() {
+			close(pow.verifying)
+			<-pow.release
+		})
+	}
+	return true
+}
+
+func (pow *gatedPoW) Difficulty(difficulty uint8) uint8 {
+	return difficulty
+}
+
+// Headers are checked without holding e.lock, against the difficulty the
+// chain retargets to from the ancestors before the fork point
+func TestVerifyHeadersWithoutLock(t *testing.T) {
+	settings := testSettings
+	settings.PoWDifficultyInBits = true
+	settings.PoWDifficultyOpBlock, settings.PoWDifficultyNoOpBlock = 4, 4
+	settings.RetargetInterval = 4
+	settings.TargetBlockInterval = 1000
+	a := newTestEngineWithInk(t, settings, 0)
+	defer os.RemoveAll(a.DataDir)
+	b := newTestEngineWithInk(t, settings, 0)
+	defer os.RemoveAll(b.DataDir)
+	a.pow, b.pow = &gatedPoW{}, &gatedPoW{}
+
+	// Blocks much faster than the target: every retarget raises the
+	// difficulty. b has the first 6, the retarget at 8 measures from 4.
+	timestamp := BlockTimestamp(time.Now())
+	for i := 0; i < 10; i++ {
+		block := NoOpBlock{Version: settings.BlockVersion, PrevHash: a.LongestLeafHash(), PubKeyMiner: a.PubKeyStr, Timestamp: timestamp + int64(i)}
+		a.AddBlockToBlockchain(block)
+		if i < 6 {
+			b.AddBlockToBlockchain(block)
+		}
+	}
+	headers := a.HeadersAfter(b.blockLocator(), maxHeadersPerCall)
+	if len(headers) != 4 {
+		t.Fatalf("expected 4 headers, got [%d]", len(headers))
+	}
+
+	gated := &gatedPoW{verifying: make(chan struct{}), release: make(chan struct{})}
+	b.pow = gated
+	result := make(chan *big.Int, 1)
+	go func() {
+		work, err := b.verifyHeaders(headers)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- work
+	}()
+
+	<-gated.verifying
+	locked := make(chan struct{})
+	go func() {
+		b.lock.Lock()
+		b.lock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Errorf("e.lock held while checking proofs of work")
+	}
+	close(gated.release)
+
+	if work := <-result; work == nil || work.Cmp(a.longestChainWork()) != 0 {
+		t.Errorf("headers lead to [%v] work, want [%v]", work, a.longestChainWork())
+	}
+}
@@ -0,0 +1,90 @@
+package miner
+
+import (
+	"net/rpc"
+	"sync"
+)
+
+// Connection to a neighbouring miner. *rpc.Client implements Peer.
+type Peer interface {
+	Call(serviceMethod string, args interface{}, reply interface{}) error
+	Close() error
+}
+
+// Carries an Engine's traffic to its neighbouring miners
+type Transport interface {
+	// Open a connection to the miner listening at ipPort
+	Dial(ipPort string) (Peer, error)
+
+	// Return a snapshot of the connected neighbours
+	// Key: neighbour's public key
+	Neighbours() map[string]Peer
+
+	// Store a connection to the neighbour with the given public key.
+	// If the neighbour is already connected, the old connection is
+	// kept, the new one is closed and false is returned.
+	AddNeighbour(key string, peer Peer) bool
+
+	// Close and forget the connection to the neighbour
+	RemoveNeighbour(key string)
+
+	// Number of connected neighbours
+	NumNeighbours() int
+}
+
+// Transport over net/rpc connections
+type RPCTransport struct {
+	neighbourLock    sync.Mutex
+	activeNeighbours map[string]Peer
+}
+
+func NewRPCTransport() *RPCTransport {
+	return &RPCTransport{activeNeighbours: make(map[string]Peer)}
+}
+
+func (t *RPCTransport) Dial(ipPort string) (Peer, error) {
+	return rpc.Dial("tcp", ipPort)
+}
+
+func (t *RPCTransport) Neighbours() map[string]Peer {
+	t.neighbourLock.Lock()
+	defer t.neighbourLock.Unlock()
+
+	neighbours := make(map[string]Peer, len(t.activeNeighbours))
+	for key, peer := range t.activeNeighbours {
+		neighbours[key] = peer
+	}
+	return neighbours
+}
+
+func (t *RPCTransport) AddNeighbour(key string, peer Peer) bool {
+	t.neighbourLock.Lock()
+	defer t.neighbourLock.Unlock()
+
+	if _, exists := t.activeNeighbours[key]; exists {
+		// if neighbour already exists, keep old connection and close the new one
+		peer.Close()
+		return false
+	}
+	t.activeNeighbours[key] = peer
+	Log.Debug("New neighbour -- Total connections [%v]", len(t.activeNeighbours))
+	return true
+}
+
+func (t *RPCTransport) RemoveNeighbour(key string) {
+	t.neighbourLock.Lock()
+	defer t.neighbourLock.Unlock()
+
+	if peer, exists := t.activeNeighbours[key]; exists {
+		peer.Close()
+		delete(t.activeNeighbours, key)
+	}
+	Log.Debug("Inactive miner removed\n Total connections [%v]", len(t.activeNeighbours))
+}
+
+func (t *RPCTransport) NumNeighbours() int {
+	t.neighbourLock.Lock()
+	defer t.neighbourLock.Unlock()
+
+	return len(t.activeNeighbours)
+}
@@ -97,6 +97,36 @@ type MinerNetSettings struct {
 	// Proof of work difficulty: number of zeroes in prefix (>=0)
 	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
 	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
+	// The difficulties above count leading zero bits instead of hex digits
+	PoWDifficultyInBits bool `json:"pow-difficulty-in-bits"`
+	// Proof of work algorithm: hash-prefix (default), memory-hard or dev
+	PoWAlgorithm string `json:"pow-algorithm"`
+
+	// Most ops in an OpBlock, and most bytes of its gob encoded ops
+	// (0: no limit)
+	MaxOpsPerBlock uint32 `json:"max-ops-per-block"`
+	MaxBlockBytes  uint32 `json:"max-block-bytes"`
+
+	// Order queued ops are picked for a block in:
+	// 0 oldest first, 1 highest fee first
+	OpOrderPolicy uint8 `json:"op-order-policy"`
+
+	// Number of blocks on top of a block before its reward and fees
+	// can be spent (0: right away)
+	RewardMaturity uint32 `json:"reward-maturity"`
+
+	// Tie-break between tips with the same cumulative work:
+	// 0 keeps the first seen tip, 1 the tip with the lowest hash
+	ForkChoicePolicy uint8 `json:"fork-choice-policy"`
+
+	// Number of blocks between difficulty retargets (0: never retarget)
+	// and the milliseconds per block retargeting aims for
+	RetargetInterval    uint32 `json:"retarget-interval"`
+	TargetBlockInterval uint32 `json:"target-block-interval"`
+
+	// Block header format and hash function: 1 MD5, 2 SHA-256.
+	// Omitted in older configs, which then keep MD5.
+	BlockVersion uint8 `json:"block-version"`
 
 	// Canvas settings
 	CanvasSettings CanvasSettings `json:"canvas-settings"`
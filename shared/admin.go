@@ -0,0 +1,38 @@
+package shared
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+const AdminMsg = "admin call signed by the miner key"
+
+// Return the hash an admin call to method is signed over
+func AdminCallHash(method string, timestamp int64, nonce uint64, peer string) []byte {
+	timestampBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestampBytes, uint64(timestamp))
+	nonceBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonceBytes, nonce)
+
+	args := [][]byte{[]byte(AdminMsg), []byte(method), timestampBytes, nonceBytes, []byte(peer)}
+	sum := sha256.Sum256(ConcateByteArr(args))
+	return sum[:]
+}
+
+// Sign a call to the admin method of the miner owning privKey
+func SignAdminCall(privKey *ecdsa.PrivateKey, method string, peer string) (args AdminArgs, err error) {
+	nonceBytes := make([]byte, 8)
+	if _, err = rand.Read(nonceBytes); err != nil {
+		return args, err
+	}
+	args = AdminArgs{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Nonce:     binary.BigEndian.Uint64(nonceBytes),
+		Peer:      peer,
+	}
+	args.R, args.S, err = ecdsa.Sign(rand.Reader, privKey, AdminCallHash(method, args.Timestamp, args.Nonce, peer))
+	return args, err
+}
@@ -0,0 +1,85 @@
+package shared
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Version of the miner-miner protocol. Miners with another version don't pair.
+const ProtocolVersion uint32 = 1
+
+const HandshakeMsg = "miner handshake signed by the miner key"
+
+// Size in bytes of a handshake challenge
+const ChallengeSize = 32
+
+// Roles a miner signs a handshake session in
+const (
+	HandshakeDialer   = "dialer"
+	HandshakeAnswerer = "answerer"
+)
+
+// Everything a handshake between a dialing and an answering miner commits
+// to: both keys, both addresses, both fresh challenges, the protocol
+// version and the genesis hash. A signature over a session can't be
+// replayed or relayed to a session with another miner or address.
+type HandshakeSession struct {
+	Version     uint32
+	GenesisHash string
+
+	DialerKey       string
+	DialerIPPort    string // address the dialing miner listens on
+	DialerChallenge []byte
+
+	AnswererKey       string
+	AnswererIPPort    string // address the dialing miner dialed
+	AnswererChallenge []byte
+}
+
+// Return a fresh random challenge
+func NewChallenge() (challenge []byte, err error) {
+	challenge = make([]byte, ChallengeSize)
+	_, err = rand.Read(challenge)
+	return challenge, err
+}
+
+// Return the hash the miner in role signs for the session
+func (session HandshakeSession) Hash(role string) []byte {
+	versionBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(versionBytes, session.Version)
+
+	args := [][]byte{[]byte(HandshakeMsg), []byte(role), versionBytes, []byte(session.GenesisHash),
+		[]byte(session.DialerKey), []byte(session.DialerIPPort), session.DialerChallenge,
+		[]byte(session.AnswererKey), []byte(session.AnswererIPPort), session.AnswererChallenge}
+	// Length prefixed, so no field can run into the next
+	var data []byte
+	for _, arg := range args {
+		lengthBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(lengthBytes, uint32(len(arg)))
+		data = append(append(data, lengthBytes...), arg...)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// Sign the session in role with privKey
+func SignHandshake(privKey *ecdsa.PrivateKey, session HandshakeSession, role string) (sig OpenArgs, err error) {
+	sig.R, sig.S, err = ecdsa.Sign(rand.Reader, privKey, session.Hash(role))
+	return sig, err
+}
+
+// Return true if sig is the signature of the session by the miner in role
+func VerifyHandshake(session HandshakeSession, role string, sig OpenArgs) bool {
+	signerKey := session.DialerKey
+	if role == HandshakeAnswerer {
+		signerKey = session.AnswererKey
+	}
+	pubKey, err := DecodePubKey(signerKey)
+	if err != nil || sig.R == nil || sig.S == nil ||
+		len(session.DialerChallenge) != ChallengeSize || len(session.AnswererChallenge) != ChallengeSize {
+		return false
+	}
+	return ecdsa.Verify(pubKey, session.Hash(role), sig.R, sig.S)
+}
@@ -0,0 +1,46 @@
+package shared
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Fields of a block that its hash commits to.
+// Ops are committed to through MerkleRoot, so the header alone is
+// enough to check an op's Merkle branch against the block hash.
+type BlockHeader struct {
+	Version     BlockVersion
+	PrevHash    string
+	MerkleRoot  string // hex encoded, empty for a NoOpBlock
+	PubKeyMiner string
+	Timestamp   int64 // Unix time in milliseconds the block was mined at
+	Nonce       uint32
+	ExtraNonce  uint32 // moved on once every Nonce has been tried
+}
+
+// Hash the header into the block hash, with the hash function of its version
+func (header BlockHeader) Hash() string {
+	return hex.EncodeToString(header.HashToBytes())
+}
+
+// Same as Hash, without hex encoding
+func (header BlockHeader) HashToBytes() []byte {
+	merkleRootBytes, _ := hex.DecodeString(header.MerkleRoot)
+	timestampBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestampBytes, uint64(header.Timestamp))
+	nonceBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(nonceBytes, header.Nonce)
+
+	args := [][]byte{[]byte(header.PrevHash), merkleRootBytes, []byte(header.PubKeyMiner), timestampBytes, nonceBytes}
+	if header.Version != BlockVersion1 {
+		args = append([][]byte{{byte(header.Version)}}, args...)
+	}
+	// Only hashed once used, so blocks mined before it existed keep their hash
+	if header.ExtraNonce != 0 {
+		extraNonceBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(extraNonceBytes, header.ExtraNonce)
+		args = append(args, extraNonceBytes)
+	}
+
+	return header.Version.Hash(ConcateByteArr(args))
+}
@@ -0,0 +1,109 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/hex"
+)
+
+// Domain separation so an internal node can't be passed off as a leaf
+var merkleNodePrefix = []byte{1}
+
+// Merkle branch proving an op is in a block (GetOpProof)
+type OpProof struct {
+	BlockHash string
+	OpHash    string
+
+	// Position of the op in the block
+	Index int
+
+	// Hex encoded sibling hashes from the leaf level up to the root
+	Branch []string
+}
+
+// Return the Merkle root of leaves, nil if there are no leaves.
+// Levels with an odd number of nodes pair the last node with itself, so
+// leaves ending in a copy of their last leaves have the same root: callers
+// must reject duplicate leaves.
+func MerkleRoot(version BlockVersion, leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		level = merkleParentLevel(version, level)
+	}
+	return level[0]
+}
+
+// Return the sibling hashes linking leaves[index] to the Merkle root
+func MerkleBranch(version BlockVersion, leaves [][]byte, index int) (branch [][]byte) {
+	level := leaves
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		branch = append(branch, level[sibling])
+
+		level = merkleParentLevel(version, level)
+		index /= 2
+	}
+	return branch
+}
+
+// Return true if branch links leaf at index to root
+func VerifyMerkleBranch(version BlockVersion, leaf []byte, index int, branch [][]byte, root []byte) bool {
+	node := leaf
+	for _, sibling := range branch {
+		if index%2 == 0 {
+			node = merkleNode(version, node, sibling)
+		} else {
+			node = merkleNode(version, sibling, node)
+		}
+		index /= 2
+	}
+	return index == 0 && bytes.Equal(node, root)
+}
+
+// Return true if proof shows the op is in the block described by header.
+// The header is checked against proof.BlockHash, so only the block hash
+// needs to be trusted.
+func VerifyOpProof(header BlockHeader, proof OpProof) bool {
+	if header.Hash() != proof.BlockHash {
+		return false
+	}
+
+	leaf, err := hex.DecodeString(proof.OpHash)
+	if err != nil {
+		return false
+	}
+	root, err := hex.DecodeString(header.MerkleRoot)
+	if err != nil {
+		return false
+	}
+	branch := make([][]byte, len(proof.Branch))
+	for i, sibling := range proof.Branch {
+		branch[i], err = hex.DecodeString(sibling)
+		if err != nil {
+			return false
+		}
+	}
+
+	return VerifyMerkleBranch(header.Version, leaf, proof.Index, branch, root)
+}
+
+func merkleParentLevel(version BlockVersion, level [][]byte) (parents [][]byte) {
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		parents = append(parents, merkleNode(version, level[i], right))
+	}
+	return parents
+}
+
+func merkleNode(version BlockVersion, left, right []byte) []byte {
+	return version.Hash(ConcateByteArr([][]byte{merkleNodePrefix, left, right}))
+}
@@ -0,0 +1,35 @@
+package shared
+
+import (
+	"testing"
+)
+
+func TestMerkleBranch(t *testing.T) {
+	for _, version := range []BlockVersion{BlockVersion1, BlockVersion2} {
+		testMerkleBranch(t, version)
+	}
+}
+
+func testMerkleBranch(t *testing.T, version BlockVersion) {
+	for numLeaves := 1; numLeaves <= 9; numLeaves++ {
+		var leaves [][]byte
+		for i := 0; i < numLeaves; i++ {
+			leaves = append(leaves, version.Hash([]byte{byte(i)}))
+		}
+		root := MerkleRoot(version, leaves)
+
+		for i, leaf := range leaves {
+			branch := MerkleBranch(version, leaves, i)
+			if !VerifyMerkleBranch(version, leaf, i, branch, root) {
+				t.Errorf("[%d] leaves: branch of leaf [%d] does not verify", numLeaves, i)
+			}
+			if VerifyMerkleBranch(version, leaf, i+len(leaves), branch, root) && numLeaves > 1 {
+				t.Errorf("[%d] leaves: branch of leaf [%d] verifies at a wrong index", numLeaves, i)
+			}
+			other := version.Hash([]byte("not in the tree"))
+			if VerifyMerkleBranch(version, other, i, branch, root) {
+				t.Errorf("[%d] leaves: foreign leaf verifies at [%d]", numLeaves, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package shared
+
+import (
+	"math/bits"
+)
+
+// Return the number of leading zero bits of hash
+func LeadingZeroBits(hash []byte) (zeros int) {
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
@@ -54,6 +54,7 @@ type AddArgs struct {
 	ValidateNum                  uint8
 	ShapeType                    ShapeType
 	ShapeSvgString, Fill, Stroke string
+	Fee                          uint32 // ink paid to the miner of the block holding the op
 }
 
 type RmArgs struct {
@@ -82,6 +83,55 @@ type GetReply struct {
 	StrArr       []string // shapeHashes[] (GetShapes) or blockHash[] (GetChildren)
 }
 
+// Ink of a miner on the longest chain (GetInkBalance)
+type InkBalance struct {
+	Mature  uint32 // spendable
+	Pending uint32 // mined in blocks not buried deep enough yet
+}
+
+// Explorer view of a block (GetBlock)
+type BlockInfo struct {
+	Version     BlockVersion
+	Hash        string
+	PrevHash    string
+	MinerPubKey string
+	Nonce       uint32
+	ExtraNonce  uint32
+	Timestamp   int64 // Unix time in milliseconds
+	Height      int   // Genesis is at height 0
+	IsOpBlock   bool
+	Difficulty  uint8 // Proof of work difficulty the block was mined at
+
+	// Blocks on top of this block on the longest chain,
+	// -1 if the block is on a side branch
+	Confirmations int
+
+	Ops []OpInfo
+}
+
+// Explorer view of an op (GetOp, GetBlock)
+type OpInfo struct {
+	OpHash    string
+	ShapeHash string
+	Add       bool // false for an op deleting the shape
+	ShapeType ShapeType
+	Svg       string
+	Fill      string
+	Stroke    string
+	Owner     string // public key of the shape owner
+	Signer    string // public key the op is signed with
+	ValidNum  uint8
+	InkCost   uint32
+	Fee       uint32 // ink paid to the block's miner
+
+	// Block holding the op, empty while the op is waiting to be mined
+	BlockHash string
+
+	// Blocks on top of BlockHash on the longest chain,
+	// -1 if the block is on a side branch or the op is not mined yet
+	Confirmations int
+}
+
 /*
  * Error Definitions
  */
@@ -149,6 +199,41 @@ func (e InvalidBlockHashError) Error() string {
 	return fmt.Sprintf("BlockArt: Invalid block hash [%s]", string(e))
 }
 
+// Contains the public key of the miner that is not a neighbour.
+type UnknownPeerError string
+
+func (e UnknownPeerError) Error() string {
+	return fmt.Sprintf("BlockArt: Not connected to miner [%s]", string(e))
+}
+
+// Contains the admin call that is not signed by the miner key.
+type AdminAuthError string
+
+func (e AdminAuthError) Error() string {
+	return fmt.Sprintf("BlockArt: Admin call not authorized [%s]", string(e))
+}
+
+// Contains the hash of the op that was not confirmed in time.
+type ConfirmationTimeoutError string
+
+func (e ConfirmationTimeoutError) Error() string {
+	return fmt.Sprintf("BlockArt: Op not confirmed before the deadline [%s]", string(e))
+}
+
+// Contains the rpc method a neighbouring miner did not answer in time.
+type PeerTimeoutError string
+
+func (e PeerTimeoutError) Error() string {
+	return fmt.Sprintf("BlockArt: Miner did not answer in time [%s]", string(e))
+}
+
+// Contains the reason a miner refused to pair.
+type HandshakeError string
+
+func (e HandshakeError) Error() string {
+	return fmt.Sprintf("BlockArt: Miner handshake failed [%s]", string(e))
+}
+
 // Arguments to contact the server
 type RegisterArgs struct {
 	Address   net.Addr
@@ -156,8 +241,55 @@ type RegisterArgs struct {
 	PubKeyStr string
 }
 
-// Arguments for Miner-Miner RPC calls
+// Arguments of MinerAdminRPC calls, signed with the miner key (SignAdminCall)
+type AdminArgs struct {
+	Timestamp int64    // Unix time in milliseconds the call was signed at
+	Nonce     uint64   // random, tells apart calls signed at the same time
+	Peer      string   // ConnectPeer: IP:Port, DisconnectPeer: public key
+	R, S      *big.Int // signature of AdminCallHash
+}
+
+// State of a miner (MinerAdminRPC.GetStatus)
+type MinerStatus struct {
+	PubKey         string
+	MiningPaused   bool
+	TipHash        string // leaf of the longest chain
+	Height         int
+	HashRate       float64 // hashes per second, estimated from the blocks sealed
+	QueuedOps      int
+	NoParentBlocks int
+	Neighbours     int
+}
+
+// Opens a handshake: the dialing miner's identity, address and network,
+// and its challenge (MinerMinerRPC.Hello)
+type HelloArgs struct {
+	Version     uint32
+	GenesisHash string
+	PubKey      string
+	IPPort      string
+	Challenge   []byte
+}
+
+// The answering miner's identity and network, and its challenge.
+// Nothing is signed until the dialing miner has proven its key.
+type HelloReply struct {
+	Version     uint32
+	GenesisHash string
+	PubKey      string
+	Challenge   []byte
+}
+
+// Arguments for Miner-Miner RPC calls: the dialing miner's signature of
+// the session opened by the Hello reply holding Challenge
 type ConnectMinerArgs struct {
-	IPPort        string
-	EncodedPubKey string
+	Challenge []byte
+	Sig       OpenArgs
+}
+
+// The answering miner's signature of the session, once the dialing
+// miner's signature checked out
+type ConnectMinerReply struct {
+	PubKey string
+	Sig    OpenArgs
 }
@@ -7,6 +7,7 @@ import (
 	"crypto/x509"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"math/rand"
 	"time"
 )
@@ -44,15 +45,20 @@ func EncodePrivKey(privKey *ecdsa.PrivateKey) (privKeyStr string, err error) {
 }
 
 // Decode hex encoded public key string
-// TODO: need to test
 func DecodePubKey(pubKeyStr string) (*ecdsa.PublicKey, error) {
 	pubKeyHex, err := hex.DecodeString(pubKeyStr)
 	if err != nil {
 		return nil, err
 	}
 	re, err := x509.ParsePKIXPublicKey(pubKeyHex)
-	pubKey := re.(*ecdsa.PublicKey)
-	return pubKey, err
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := re.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an ECDSA public key")
+	}
+	return pubKey, nil
 }
 
 func EncodePubKey(pubKey ecdsa.PublicKey) (pubKeyStr string, err error) {
@@ -0,0 +1,45 @@
+package shared
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+)
+
+// Version of the block header format. It also selects the hash function
+// used for the block, the Merkle tree of its ops, the ops and their shapes.
+type BlockVersion uint8
+
+const (
+	// MD5 hashes, header without a version byte.
+	// Networks configured before block versions existed use it.
+	BlockVersion1 BlockVersion = 1
+	// SHA-256 hashes, header prefixed with its version byte
+	BlockVersion2 BlockVersion = 2
+)
+
+// Return true if the version is one this code can hash and validate
+func (version BlockVersion) Valid() bool {
+	return version == BlockVersion1 || version == BlockVersion2
+}
+
+// Hash data with the version's hash function
+func (version BlockVersion) Hash(data []byte) (hashedData []byte) {
+	switch version {
+	case BlockVersion2:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	default:
+		sum := md5.Sum(data)
+		return sum[:]
+	}
+}
+
+// Number of bits in the version's hashes
+func (version BlockVersion) HashBits() int {
+	switch version {
+	case BlockVersion2:
+		return sha256.Size * 8
+	default:
+		return md5.Size * 8
+	}
+}
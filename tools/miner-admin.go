@@ -0,0 +1,205 @@
+package main
+
+import (
+	"../shared"
+	"crypto/ecdsa"
+	"fmt"
+	"net/rpc"
+	"os"
+)
+
+type Error string
+
+func (e Error) Error() string {
+	return fmt.Sprintf("#### Error: [%s]", string(e))
+}
+
+var (
+	client  *rpc.Client
+	privKey *ecdsa.PrivateKey
+)
+
+// go run tools/miner-admin.go [admin ip:port] [privKey] [command] [arg]
+// The admin ip:port is in the miner's data directory, in admin-addr
+func main() {
+	args := os.Args[1:]
+	if len(args) < 3 {
+		usage()
+		os.Exit(1)
+	}
+
+	var err error
+	privKey, err = shared.DecodePrivKey(args[1])
+	if err != nil {
+		fmt.Println(Error(err.Error()).Error())
+		os.Exit(1)
+	}
+
+	client, err = rpc.Dial("tcp", args[0])
+	if err != nil {
+		fmt.Println(Error(err.Error()).Error())
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	var e error
+	switch args[2] {
+	case "pause":
+		e = Pause(args[3:])
+	case "resume":
+		e = Resume(args[3:])
+	case "status":
+		e = Status(args[3:])
+	case "ops":
+		e = Ops(args[3:])
+	case "orphans":
+		e = Orphans(args[3:])
+	case "peers":
+		e = Peers(args[3:])
+	case "connect":
+		e = Connect(args[3:])
+	case "disconnect":
+		e = Disconnect(args[3:])
+	default:
+		usage()
+		os.Exit(1)
+	}
+
+	if e != nil {
+		fmt.Println(e.Error())
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Printf("usage: miner-admin <admin IP:Port> <private key> <command>\ncommands:\n - pause\n - resume\n - status\n - ops\n - orphans\n - peers\n - connect <miner IP:Port>\n - disconnect <miner public key>\n")
+}
+
+// Sign and send an admin call
+func call(method string, peer string, reply interface{}) error {
+	args, err := shared.SignAdminCall(privKey, method, peer)
+	if err != nil {
+		return err
+	}
+	return client.Call("MinerAdminRPC."+method, args, reply)
+}
+
+func Pause(args []string) error {
+	if len(args) != 0 {
+		return Error("pause takes 0 args")
+	}
+
+	var ok bool
+	if err := call("PauseMining", "", &ok); err != nil {
+		return err
+	}
+	Output("mining paused")
+	return nil
+}
+
+func Resume(args []string) error {
+	if len(args) != 0 {
+		return Error("resume takes 0 args")
+	}
+
+	var ok bool
+	if err := call("ResumeMining", "", &ok); err != nil {
+		return err
+	}
+	Output("mining resumed")
+	return nil
+}
+
+func Status(args []string) error {
+	if len(args) != 0 {
+		return Error("status takes 0 args")
+	}
+
+	var status shared.MinerStatus
+	if err := call("GetStatus", "", &status); err != nil {
+		return err
+	}
+	Output(fmt.Sprintf("miner [%s]", status.PubKey))
+	Output(fmt.Sprintf("mining paused [%t], hash rate [%.0f H/s]", status.MiningPaused, status.HashRate))
+	Output(fmt.Sprintf("tip [%s], height [%d]", status.TipHash, status.Height))
+	Output(fmt.Sprintf("queued ops [%d], blocks without parent [%d], neighbours [%d]", status.QueuedOps, status.NoParentBlocks, status.Neighbours))
+	return nil
+}
+
+func Ops(args []string) error {
+	if len(args) != 0 {
+		return Error("ops takes 0 args")
+	}
+
+	var ops []shared.OpInfo
+	if err := call("GetOpQueue", "", &ops); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		Output(fmt.Sprintf("op [%s], add [%t], svg [%s], ink [%d], fee [%d], validNum [%d]", op.OpHash, op.Add, op.Svg, op.InkCost, op.Fee, op.ValidNum))
+	}
+	Output(fmt.Sprintf("%d queued ops", len(ops)))
+	return nil
+}
+
+func Orphans(args []string) error {
+	if len(args) != 0 {
+		return Error("orphans takes 0 args")
+	}
+
+	var blocks []shared.BlockInfo
+	if err := call("GetNoParentBlocks", "", &blocks); err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		Output(fmt.Sprintf("block [%s], parent [%s], ops [%d]", block.Hash, block.PrevHash, len(block.Ops)))
+	}
+	Output(fmt.Sprintf("%d blocks without parent", len(blocks)))
+	return nil
+}
+
+func Peers(args []string) error {
+	if len(args) != 0 {
+		return Error("peers takes 0 args")
+	}
+
+	var pubKeys []string
+	if err := call("GetNeighbours", "", &pubKeys); err != nil {
+		return err
+	}
+	for _, pubKey := range pubKeys {
+		Output(pubKey)
+	}
+	Output(fmt.Sprintf("%d neighbours", len(pubKeys)))
+	return nil
+}
+
+func Connect(args []string) error {
+	if len(args) != 1 {
+		return Error("connect takes 1 arg")
+	}
+
+	var pubKey string
+	if err := call("ConnectPeer", args[0], &pubKey); err != nil {
+		return err
+	}
+	Output(fmt.Sprintf("connected to [%s]", pubKey))
+	return nil
+}
+
+func Disconnect(args []string) error {
+	if len(args) != 1 {
+		return Error("disconnect takes 1 arg")
+	}
+
+	var ok bool
+	if err := call("DisconnectPeer", args[0], &ok); err != nil {
+		return err
+	}
+	Output("disconnected")
+	return nil
+}
+
+func Output(msg string) {
+	fmt.Println("-->", msg)
+}